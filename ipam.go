@@ -21,16 +21,26 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/armon/go-radix"
 	etcd "github.com/coreos/etcd/client"
 	"github.com/osrg/gobgp/table"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 )
 
+// IPIP modes of an IP pool
+const (
+	ipipModeNever       = "never"
+	ipipModeAlways      = "always"
+	ipipModeCrossSubnet = "cross-subnet"
+)
+
 type ipPool struct {
 	CIDR string `json:"cidr"`
 	IPIP string `json:"ipip"`
 	Mode string `json:"ipip_mode"`
+	// Disabled pools are not used for new allocations
+	Disabled bool `json:"disabled"`
 }
 
 func (lhs *ipPool) equal(rhs *ipPool) bool {
@@ -40,42 +50,101 @@ func (lhs *ipPool) equal(rhs *ipPool) bool {
 	if lhs == nil || rhs == nil {
 		return false
 	}
-	return lhs.CIDR == rhs.CIDR && lhs.IPIP == rhs.IPIP && lhs.Mode == rhs.Mode
+	return lhs.CIDR == rhs.CIDR && lhs.IPIP == rhs.IPIP && lhs.Mode == rhs.Mode && lhs.Disabled == rhs.Disabled
 }
 
-// Contain returns true if this ipPool contains 'prefix'
+// ipipMode returns the IPIP mode of the pool. Calico stores the name of the
+// tunnel interface in "ipip" for IPIP pools and sets "ipip_mode" only to
+// restrict encapsulation to cross-subnet traffic.
+func (p *ipPool) ipipMode() string {
+	if p.IPIP == "" {
+		return ipipModeNever
+	}
+	if p.Mode == ipipModeCrossSubnet {
+		return ipipModeCrossSubnet
+	}
+	return ipipModeAlways
+}
+
+// Contain returns true if this ipPool contains 'prefix'.
+// The radix keys of IPv4 and IPv6 prefixes can share a leading bit string,
+// so the address families are compared first.
 func (p *ipPool) contain(prefix string) bool {
+	if isIPv6Prefix(prefix) != isIPv6Prefix(p.CIDR) {
+		return false
+	}
 	k := table.CidrToRadixkey(prefix)
 	l := table.CidrToRadixkey(p.CIDR)
 	return strings.HasPrefix(k, l)
 }
 
+// isIPv6Prefix returns true if 'prefix' is an IPv6 prefix
+func isIPv6Prefix(prefix string) bool {
+	return strings.Contains(prefix, ":")
+}
+
 type ipamCache struct {
-	mu            sync.RWMutex
-	m             map[string]*ipPool
-	etcdAPI       etcd.KeysAPI
-	updateHandler func(*ipPool) error
+	mu sync.RWMutex
+	m  map[string]*ipPool
+	// trees index the pools in 'm' by the radix key of their CIDR for the
+	// longest prefix match. IPv4 and IPv6 pools are in separate trees, as
+	// their keys can collide.
+	trees   map[bool]*radix.Tree
+	etcdAPI etcd.KeysAPI
+	// updateHandlers are called in order when a pool is added, changed
+	// or deleted
+	updateHandlers []func(*ipPool) error
+	// syncHandler, if set, is called every time the cache is in sync
+	// with etcd
+	syncHandler func()
+	// pause, if set, is called before each change from etcd is applied
+	// and may block to hold it back
+	pause func()
+	// ready is closed once the pools have been loaded
+	ready chan struct{}
+}
+
+// waitReady blocks until the pools have been loaded, or 'cancel' is closed.
+// It returns false in the latter case.
+func (c *ipamCache) waitReady(cancel <-chan struct{}) bool {
+	select {
+	case <-c.ready:
+		return true
+	case <-cancel:
+		return false
+	}
 }
 
 // match checks whether we have an IP pool which contains the given prefix.
-// If we have, it returns the pool.
+// If we have, it returns the pool. When pools overlap, the most specific
+// one is returned.
 func (c *ipamCache) match(prefix string) *ipPool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
+	_, v, ok := c.trees[isIPv6Prefix(prefix)].LongestPrefix(table.CidrToRadixkey(prefix))
+	if !ok {
+		return nil
+	}
+	return v.(*ipPool)
+}
+
+// pools returns a copy of the cached IP pools
+func (c *ipamCache) pools() []ipPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ps := make([]ipPool, 0, len(c.m))
 	for _, p := range c.m {
-		if p.contain(prefix) {
-			return p
-		}
+		ps = append(ps, *p)
 	}
-	return nil
+	return ps
 }
 
 // update updates the internal map with IPAM updates when the update
-// is new addtion to the map or changes the existing item, it calls
-// updateHandler
+// is new addtion to the map, changes the existing item or deletes it, it
+// calls updateHandlers. updateHandlers are called without holding the lock,
+// so that they can call match. A failing handler doesn't prevent the
+// following ones from being called.
 func (c *ipamCache) update(node *etcd.Node, del bool) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
 	log.Printf("update ipam cache: %s, %v, %t", node.Key, node.Value, del)
 	if node.Dir {
 		return nil
@@ -87,18 +156,29 @@ func (c *ipamCache) update(node *etcd.Node, del bool) error {
 	if p.CIDR == "" {
 		return fmt.Errorf("empty cidr: %s", node.Value)
 	}
+	c.mu.Lock()
 	q := c.m[p.CIDR]
+	tree := c.trees[isIPv6Prefix(p.CIDR)]
 	if del {
 		delete(c.m, p.CIDR)
-		return nil
+		tree.Delete(table.CidrToRadixkey(p.CIDR))
 	} else if p.equal(q) {
+		c.mu.Unlock()
 		return nil
+	} else {
+		c.m[p.CIDR] = p
+		tree.Insert(table.CidrToRadixkey(p.CIDR), p)
 	}
+	c.mu.Unlock()
 
-	c.m[p.CIDR] = p
-
-	if c.updateHandler != nil {
-		return c.updateHandler(p)
+	var errs []string
+	for _, handler := range c.updateHandlers {
+		if err := handler(p); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to handle the update of pool %s: %s", p.CIDR, strings.Join(errs, ", "))
 	}
 	return nil
 }
@@ -135,8 +215,15 @@ func (c *ipamCache) sync() error {
 			return err
 		}
 	}
+	close(c.ready)
+	if c.syncHandler != nil {
+		c.syncHandler()
+	}
 
-	watcher := c.etcdAPI.Watcher(CALICO_IPAM, &etcd.WatcherOptions{Recursive: true, AfterIndex: index})
+	watcher, err := newStaleWatcher("ipam", c.etcdAPI.Watcher(CALICO_IPAM, &etcd.WatcherOptions{Recursive: true, AfterIndex: index}))
+	if err != nil {
+		return err
+	}
 	for {
 		res, err := watcher.Next(context.Background())
 		if err != nil {
@@ -153,18 +240,26 @@ func (c *ipamCache) sync() error {
 			log.Printf("unhandled action: %s", res.Action)
 			continue
 		}
+		if c.pause != nil {
+			c.pause()
+		}
 		if err = c.update(node, del); err != nil {
 			return err
 		}
+		if c.syncHandler != nil {
+			c.syncHandler()
+		}
 	}
 	return nil
 }
 
 // create new IPAM cache
-func newIPAMCache(api etcd.KeysAPI, updateHandler func(*ipPool) error) *ipamCache {
+func newIPAMCache(api etcd.KeysAPI, updateHandlers ...func(*ipPool) error) *ipamCache {
 	return &ipamCache{
-		m:             make(map[string]*ipPool),
-		updateHandler: updateHandler,
-		etcdAPI:       api,
+		m:              make(map[string]*ipPool),
+		trees:          map[bool]*radix.Tree{false: radix.New(), true: radix.New()},
+		updateHandlers: updateHandlers,
+		etcdAPI:        api,
+		ready:          make(chan struct{}),
 	}
 }
@@ -0,0 +1,274 @@
+// Copyright (C) 2017 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+// testIPAMCache returns a cache holding pools of the given CIDRs
+func testIPAMCache(tb testing.TB, cidrs ...string) *ipamCache {
+	c := newIPAMCache(nil)
+	for _, cidr := range cidrs {
+		node := &etcd.Node{Value: fmt.Sprintf(`{"cidr":"%s"}`, cidr)}
+		if err := c.update(node, false); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return c
+}
+
+// linearMatch is the lookup match replaced: a scan of every pool for the
+// longest one containing 'prefix'
+func linearMatch(c *ipamCache, prefix string) *ipPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var ret *ipPool
+	longest := -1
+	for _, p := range c.m {
+		if !p.contain(prefix) {
+			continue
+		}
+		_, ipNet, _ := net.ParseCIDR(p.CIDR)
+		if ones, _ := ipNet.Mask.Size(); ones > longest {
+			ret, longest = p, ones
+		}
+	}
+	return ret
+}
+
+func TestPoolMatch(t *testing.T) {
+	c := testIPAMCache(t, "192.168.0.0/16", "192.168.1.0/24", "10.0.0.0/8", "fd00::/64", "c0a8::/16")
+	for _, tc := range []struct {
+		prefix string
+		want   string
+	}{
+		{"192.168.1.0/26", "192.168.1.0/24"},
+		{"192.168.2.0/26", "192.168.0.0/16"},
+		{"192.168.1.0/24", "192.168.1.0/24"},
+		{"192.0.0.0/8", ""},
+		{"10.1.2.3/32", "10.0.0.0/8"},
+		{"172.16.0.0/26", ""},
+		{"fd00::/122", "fd00::/64"},
+		{"fd00:0:0:1::/122", ""},
+		// shares the leading bits of the radix key of 192.168.0.0/16
+		{"c0a8:100::/122", "c0a8::/16"},
+		{"c0a9::/122", ""},
+	} {
+		got := ""
+		if p := c.match(tc.prefix); p != nil {
+			got = p.CIDR
+		}
+		if got != tc.want {
+			t.Errorf("match(%s) = %q, want %q", tc.prefix, got, tc.want)
+		}
+		want := ""
+		if p := linearMatch(c, tc.prefix); p != nil {
+			want = p.CIDR
+		}
+		if got != want {
+			t.Errorf("match(%s) = %q, the linear scan returns %q", tc.prefix, got, want)
+		}
+	}
+
+	node := &etcd.Node{Value: `{"cidr":"192.168.1.0/24"}`}
+	if err := c.update(node, true); err != nil {
+		t.Fatal(err)
+	}
+	if p := c.match("192.168.1.0/26"); p == nil || p.CIDR != "192.168.0.0/16" {
+		t.Errorf("match after the deletion = %v, want 192.168.0.0/16", p)
+	}
+}
+
+// benchmarkPools returns 'n' /24 pools and a block in the last one
+func benchmarkPools(n int) ([]string, string) {
+	cidrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+	}
+	return cidrs, fmt.Sprintf("10.%d.%d.64/26", (n-1)/256, (n-1)%256)
+}
+
+func BenchmarkPoolLookup(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		cidrs, block := benchmarkPools(n)
+		c := testIPAMCache(b, cidrs...)
+		b.Run(fmt.Sprintf("radix/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.match(block)
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearMatch(c, block)
+			}
+		})
+	}
+}
+
+func TestPoolMatchMostSpecific(t *testing.T) {
+	c := testIPAMCache(t, "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24")
+	for _, want := range []string{"10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8", ""} {
+		got := ""
+		if p := c.match("10.1.2.64/26"); p != nil {
+			got = p.CIDR
+		}
+		if got != want {
+			t.Fatalf("match = %q, want %q", got, want)
+		}
+		if want == "" {
+			break
+		}
+		// the pool matched is deleted, so that the next one matches
+		node := &etcd.Node{Value: fmt.Sprintf(`{"cidr":"%s"}`, want)}
+		if err := c.update(node, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPoolContain(t *testing.T) {
+	for _, tc := range []struct {
+		pool   string
+		prefix string
+		want   bool
+	}{
+		{"192.168.0.0/16", "192.168.1.0/26", true},
+		{"192.168.0.0/16", "192.169.0.0/26", false},
+		{"fd00::/64", "fd00::40/122", true},
+		{"fd00::/64", "fd00:0:0:1::/122", false},
+		// the radix key of c0a8::/16 starts with the one of 192.168.0.0/16
+		{"192.168.0.0/16", "c0a8::/122", false},
+		{"c0a8::/16", "192.168.1.0/26", false},
+	} {
+		p := &ipPool{CIDR: tc.pool}
+		if got := p.contain(tc.prefix); got != tc.want {
+			t.Errorf("%s contains %s: %t, want %t", tc.pool, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateHandlers(t *testing.T) {
+	var calls []string
+	handler := func(name string, err error) func(*ipPool) error {
+		return func(p *ipPool) error {
+			calls = append(calls, fmt.Sprintf("%s %s", name, p.CIDR))
+			return err
+		}
+	}
+	c := newIPAMCache(nil, handler("first", errors.New("first failed")), handler("second", nil), handler("third", errors.New("third failed")))
+	node := &etcd.Node{Value: `{"cidr":"192.168.0.0/16"}`}
+	err := c.update(node, false)
+	if err == nil || !strings.Contains(err.Error(), "first failed") || !strings.Contains(err.Error(), "third failed") {
+		t.Errorf("error = %v, want the errors of the first and third handlers", err)
+	}
+	want := []string{"first 192.168.0.0/16", "second 192.168.0.0/16", "third 192.168.0.0/16"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+
+	// an unchanged pool doesn't call the handlers
+	calls = nil
+	if err = c.update(node, false); err != nil {
+		t.Error(err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("calls for an unchanged pool = %v, want none", calls)
+	}
+}
+
+func TestPoolRehome(t *testing.T) {
+	const prefix = "192.168.1.64/26"
+	var c *ipamCache
+	var matched []string
+	// the handler is called without the lock held, so it can look up the
+	// pool which matches the prefix now, like ipamUpdateHandler does
+	c = newIPAMCache(nil, func(*ipPool) error {
+		p := c.match(prefix)
+		if p == nil {
+			matched = append(matched, "")
+			return nil
+		}
+		matched = append(matched, fmt.Sprintf("%s %s", p.CIDR, p.ipipMode()))
+		return nil
+	})
+	for _, tc := range []struct {
+		value string
+		del   bool
+	}{
+		{`{"cidr":"192.168.0.0/16","ipip":"tunl0"}`, false},
+		// a more specific pool re-homes the prefix
+		{`{"cidr":"192.168.1.0/24"}`, false},
+		{`{"cidr":"192.168.1.0/24","ipip":"tunl0","ipip_mode":"cross-subnet"}`, false},
+		{`{"cidr":"192.168.1.0/24"}`, true},
+		{`{"cidr":"192.168.0.0/16"}`, true},
+	} {
+		if err := c.update(&etcd.Node{Value: tc.value}, tc.del); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"192.168.0.0/16 always",
+		"192.168.1.0/24 never",
+		"192.168.1.0/24 cross-subnet",
+		"192.168.0.0/16 always",
+		"",
+	}
+	if !reflect.DeepEqual(matched, want) {
+		t.Errorf("matched %q, want %q", matched, want)
+	}
+}
+
+func TestNeedsIPIP(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	for _, tc := range []struct {
+		pool ipPool
+		mode string
+		// whether a gateway within and out of the subnet needs IPIP
+		within, across bool
+	}{
+		{ipPool{CIDR: "192.168.0.0/16"}, ipipModeNever, false, false},
+		{ipPool{CIDR: "192.168.0.0/16", Mode: ipipModeCrossSubnet}, ipipModeNever, false, false},
+		{ipPool{CIDR: "192.168.0.0/16", IPIP: "tunl0"}, ipipModeAlways, true, true},
+		{ipPool{CIDR: "192.168.0.0/16", IPIP: "tunl0", Mode: ipipModeAlways}, ipipModeAlways, true, true},
+		{ipPool{CIDR: "192.168.0.0/16", IPIP: "tunl0", Mode: ipipModeCrossSubnet}, ipipModeCrossSubnet, false, true},
+	} {
+		p := tc.pool
+		if got := p.ipipMode(); got != tc.mode {
+			t.Errorf("%+v: mode %s, want %s", p, got, tc.mode)
+		}
+		if got := needsIPIP(&p, net.ParseIP("10.0.0.2"), *subnet); got != tc.within {
+			t.Errorf("%+v: IPIP within the subnet %t, want %t", p, got, tc.within)
+		}
+		if got := needsIPIP(&p, net.ParseIP("10.0.1.2"), *subnet); got != tc.across {
+			t.Errorf("%+v: IPIP across the subnet %t, want %t", p, got, tc.across)
+		}
+	}
+
+	// a change of the mode alone is a change of the pool
+	always := &ipPool{CIDR: "192.168.0.0/16", IPIP: "tunl0"}
+	crossSubnet := &ipPool{CIDR: "192.168.0.0/16", IPIP: "tunl0", Mode: ipipModeCrossSubnet}
+	if always.equal(crossSubnet) {
+		t.Error("pools of different IPIP modes are equal")
+	}
+}
@@ -17,11 +17,20 @@ package main
 
 import (
 	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -35,7 +44,6 @@ import (
 	calicoapi "github.com/projectcalico/libcalico-go/lib/api"
 	calicocli "github.com/projectcalico/libcalico-go/lib/client"
 	"github.com/projectcalico/libcalico-go/lib/numorstring"
-	calicoscope "github.com/projectcalico/libcalico-go/lib/scope"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/net/context"
@@ -52,15 +60,352 @@ const (
 
 	defaultDialTimeout = 30 * time.Second
 
+	// CONFIG_FILE is the path of a JSON object whose members set the
+	// environment variables of this daemon, e.g. {"NODENAME": "node1",
+	// "CALICO_BGP_LISTEN_PORT": 1179}. Variables already set in the
+	// environment take precedence over the file.
+	CONFIG_FILE = "CALICO_BGP_CONFIG_FILE"
+
+	// PREFIX_COUNT_INTERVAL is how often per-neighbor prefix counts are
+	// logged and updated in the metrics. Set it to "0" to disable the
+	// report.
+	PREFIX_COUNT_INTERVAL      = "CALICO_BGP_PREFIX_COUNT_INTERVAL"
+	defaultPrefixCountInterval = 5 * time.Minute
+
+	// METRICS_ADDR is the address the metrics are served at, as the JSON
+	// of expvar at /debug/vars, e.g. "127.0.0.1:9101". Unset, they aren't
+	// served.
+	METRICS_ADDR = "CALICO_BGP_METRICS_ADDR"
+
+	// DEFAULT_AS and DEFAULT_NODE_MESH override the global AS number and
+	// the node-to-node mesh state used when they are not set in etcd
+	DEFAULT_AS        = "CALICO_BGP_DEFAULT_AS"
+	DEFAULT_NODE_MESH = "CALICO_BGP_DEFAULT_NODE_MESH"
+	defaultGlobalASN  = 64512
+
+	// ASN_PRECEDENCE is the comma separated order in which the sources of
+	// the AS number of a node are tried: "node" for the node's as_num,
+	// "global" for /calico/bgp/v1/global/as_num and "default" for
+	// DEFAULT_AS. A source which is unset, or invalid, falls through to the
+	// next one.
+	ASN_PRECEDENCE       = "CALICO_BGP_ASN_PRECEDENCE"
+	defaultASNPrecedence = "node,global,default"
+
+	// SUMMARIZE_POOLS advertises a pool instead of its blocks while all of
+	// them are assigned to this node, and the blocks again once one of
+	// them is released
+	SUMMARIZE_POOLS = "CALICO_BGP_SUMMARIZE_POOLS"
+
+	// ADVERTISE_DEFAULT_ROUTE makes this node originate default routes
+	ADVERTISE_DEFAULT_ROUTE = "CALICO_BGP_ADVERTISE_DEFAULT_ROUTE"
+
+	// LOOPBACK_ADDRESS is advertised as a host route and used as the next
+	// hop of the other prefixes of its address family
+	LOOPBACK_ADDRESS = "CALICO_BGP_LOOPBACK_ADDRESS"
+
+	// ANYCAST_ADDRESSES is a comma separated list of addresses advertised
+	// as host routes. Every node configured with the same address
+	// advertises the same route, so peers spread traffic to it across the
+	// nodes with ECMP where multipath is enabled.
+	ANYCAST_ADDRESSES = "CALICO_BGP_ANYCAST_ADDRESSES"
+
+	// GRACEFUL_RESTART_STALE_TIME enables graceful restart (RFC 4724) and
+	// long-lived graceful restart on every neighbor. The neighbors keep
+	// our routes for this long after we restart.
+	GRACEFUL_RESTART_STALE_TIME = "CALICO_BGP_GRACEFUL_RESTART_STALE_TIME"
+	gracefulRestartTime         = 120 // seconds
+	maxLongLivedStaleTime       = 1<<24 - 1
+
+	// MRAI is the minimum route advertisement interval of every neighbor,
+	// e.g. "5s". The "mrai" field of a peer overrides it. gobgp's default
+	// applies when neither is set.
+	MRAI = "CALICO_BGP_MRAI"
+
+	// BLACKHOLE_PREFIXES is a comma separated list of prefixes advertised
+	// with BLACKHOLE_COMMUNITY, "65535:666" (RFC 7999) by default, so that
+	// the peers drop the traffic to them. When BLACKHOLE_NEXTHOP is set,
+	// it is advertised as their next hop instead of this node's address.
+	// It is a comma separated list of at most one address per family, and
+	// must have one of the family of every prefix.
+	BLACKHOLE_PREFIXES        = "CALICO_BGP_BLACKHOLE_PREFIXES"
+	BLACKHOLE_COMMUNITY       = "CALICO_BGP_BLACKHOLE_COMMUNITY"
+	BLACKHOLE_NEXTHOP         = "CALICO_BGP_BLACKHOLE_NEXTHOP"
+	defaultBlackholeCommunity = "65535:666"
+
+	// CANARY_PREFIXES is a comma separated list of prefixes advertised in
+	// the "canary" path set, which is withdrawn at once on SIGHUP without
+	// touching the other advertisements
+	CANARY_PREFIXES = "CALICO_BGP_CANARY_PREFIXES"
+	staticPathSet   = "static"
+	canaryPathSet   = "canary"
+
+	// STRICT_VALIDATION makes the daemon refuse a neighbor configuration
+	// which validateNeighbors finds errors in, instead of only logging them
+	STRICT_VALIDATION = "CALICO_BGP_STRICT_VALIDATION"
+
+	// MAX_NEIGHBORS caps the number of neighbors. Neighbors beyond it are
+	// logged, counted in the calico_bgp_neighbors_skipped metric and
+	// skipped. Zero (the default) means no limit.
+	MAX_NEIGHBORS = "CALICO_BGP_MAX_NEIGHBORS"
+
+	// RESOLVE_INTERVAL enables peers whose "ip" is a hostname. The
+	// hostnames are resolved again every RESOLVE_INTERVAL, and a neighbor
+	// is re-added when its address changes.
+	RESOLVE_INTERVAL = "CALICO_BGP_RESOLVE_INTERVAL"
+
+	// IPV6_AS is the local AS of the IPv6 sessions, and the peer AS of the
+	// IPv6 mesh sessions, as every node is expected to set the same one.
+	// The IPv6 sessions use the node's AS number when it is not set.
+	IPV6_AS = "CALICO_BGP_IPV6_AS"
+
+	// EXPORT_LEARNED_ROUTES set to true allows the routes learned from
+	// any peer, eBGP, iBGP or confederation, to be re-advertised. By
+	// default only the routes this node originates are exported; they are
+	// tracked in the 'originated' prefix-set, so a learned route of a
+	// prefix this node also originates is exported too. The routes
+	// redistributed from zebra aren't originated by this daemon, and only
+	// IPv4 and IPv6 unicast routes are filtered.
+	EXPORT_LEARNED_ROUTES = "CALICO_BGP_EXPORT_LEARNED_ROUTES"
+
+	// PRIVATE_PEER_PROFILE and PUBLIC_PEER_PROFILE are the defaults of the
+	// optional fields of peers with a private (RFC 1918, RFC 6598, unique
+	// local, loopback or link-local) or a public address respectively, in
+	// the JSON format of the peers stored in etcd. The fields of a peer
+	// override its profile.
+	PRIVATE_PEER_PROFILE = "CALICO_BGP_PRIVATE_PEER_PROFILE"
+	PUBLIC_PEER_PROFILE  = "CALICO_BGP_PUBLIC_PEER_PROFILE"
+
+	// SHUTDOWN_MESSAGE is sent as the administrative shutdown communication
+	// (RFC 8203) to a neighbor being removed. "{address}" and
+	// "{description}" are replaced with the neighbor's.
+	SHUTDOWN_MESSAGE = "CALICO_BGP_SHUTDOWN_MESSAGE"
+
+	// CONFEDERATION_ID and CONFEDERATION_MEMBERS (a comma separated list of
+	// AS numbers) make this node a member of a BGP confederation
+	CONFEDERATION_ID      = "CALICO_BGP_CONFEDERATION_ID"
+	CONFEDERATION_MEMBERS = "CALICO_BGP_CONFEDERATION_MEMBERS"
+
+	// IPV4_ADDRESS and IPV6_ADDRESS override the BGP addresses of the node
+	// resource, which are used as router id and next hops
+	IPV4_ADDRESS = "CALICO_BGP_IPV4_ADDRESS"
+	IPV6_ADDRESS = "CALICO_BGP_IPV6_ADDRESS"
+
+	// FAMILIES is a comma separated list of the address families enabled on
+	// every neighbor, e.g. "ipv4-unicast,ipv6-unicast". When it is not set,
+	// the unicast family of the neighbor address is enabled.
+	FAMILIES = "CALICO_BGP_FAMILIES"
+
+	// LISTEN_PORT is the port the BGP server listens on
+	LISTEN_PORT = "CALICO_BGP_LISTEN_PORT"
+
+	// OBSERVE_ONLY makes the daemon only log the neighbors and paths it
+	// would configure, without changing the BGP server or kernel routes.
+	// The BGP server doesn't listen and the gRPC API isn't served. The
+	// number of skipped operations of each kind is in the status file.
+	OBSERVE_ONLY = "CALICO_BGP_OBSERVE_ONLY"
+
+	// ESTABLISHED_WAIT delays advertising the prefixes assigned to this
+	// node until a BGP session is established, for at most the given
+	// duration. Zero (the default) advertises them immediately.
+	ESTABLISHED_WAIT = "CALICO_BGP_ESTABLISHED_WAIT"
+
+	// EXPORT_POOLS_ONLY restricts the advertised prefixes to the ones
+	// within an enabled IP pool. Note that this also filters the loopback
+	// address and the default routes unless a pool contains them.
+	EXPORT_POOLS_ONLY = "CALICO_BGP_EXPORT_POOLS_ONLY"
+
+	// ORIGIN is the ORIGIN attribute of the advertised prefixes; one of
+	// "igp" (the default), "egp" and "incomplete"
+	ORIGIN = "CALICO_BGP_ORIGIN"
+
+	// MED is the MULTI_EXIT_DISC attribute of the advertised prefixes.
+	// MED_OVERRIDES is a comma separated list of "prefix=med" entries
+	// which set it for individual prefixes. MED is not sent when neither
+	// applies.
+	MED           = "CALICO_BGP_MED"
+	MED_OVERRIDES = "CALICO_BGP_MED_OVERRIDES"
+
+	// NODE_COMMUNITY tags the advertised prefixes with the large community
+	// "asn:id:0" identifying this node. It is "asn:id", or "asn" alone to
+	// derive the id from the FNV-1a hash of NODENAME.
+	NODE_COMMUNITY = "CALICO_BGP_NODE_COMMUNITY"
+
+	// VRF is the name of the gobgp VRF the prefixes assigned to this node
+	// are advertised in, instead of the global table. VRF_RD is its route
+	// distinguisher and VRF_RT a comma separated list of its import and
+	// export route targets. The neighbors need a VPN family in FAMILIES
+	// to receive them.
+	VRF    = "CALICO_BGP_VRF"
+	VRF_RD = "CALICO_BGP_VRF_RD"
+	VRF_RT = "CALICO_BGP_VRF_RT"
+
+	// ZEBRA_URL connects the BGP server to zebra, e.g.
+	// "unix:/var/run/quagga/zserv.api", so that the best paths are
+	// installed in the kernel FIB. ZEBRA_VERSION is the zebra API version
+	// and ZEBRA_REDISTRIBUTE a comma separated list of the route types,
+	// e.g. "connect,static", zebra redistributes into BGP.
+	ZEBRA_URL           = "CALICO_BGP_ZEBRA_URL"
+	ZEBRA_VERSION       = "CALICO_BGP_ZEBRA_VERSION"
+	ZEBRA_REDISTRIBUTE  = "CALICO_BGP_ZEBRA_REDISTRIBUTE"
+	defaultZebraVersion = 2
+
+	// STATIC_NEIGHBORS_FILE is the path of a JSON file with a list of
+	// neighbors in the format of the peers stored in etcd. They are read
+	// at startup, and again when the modification time of the file
+	// changes, checked every staticNeighborsCheckInterval. The peers in
+	// etcd with the same address win.
+	STATIC_NEIGHBORS_FILE        = "CALICO_BGP_STATIC_NEIGHBORS_FILE"
+	staticNeighborsCheckInterval = 10 * time.Second
+
+	// UNNUMBERED_INTERFACES is a comma separated list of "interface:AS"
+	// entries. A neighbor is added over each interface with the IPv6
+	// link-local address of the router found on it (BGP unnumbered).
+	UNNUMBERED_INTERFACES = "CALICO_BGP_UNNUMBERED_INTERFACES"
+
+	// A failed etcd watch is retried and the last known configuration is
+	// kept. When STALE_LIMIT is set, the daemon exits once the watch has
+	// failed for longer than STALE_LIMIT, or only warns if STALE_ACTION is
+	// "warn".
+	STALE_LIMIT       = "CALICO_BGP_STALE_LIMIT"
+	STALE_ACTION      = "CALICO_BGP_STALE_ACTION"
+	staleActionExit   = "exit"
+	staleActionWarn   = "warn"
+	watchRetryWait    = time.Second
+	maxWatchRetryWait = 30 * time.Second
+
+	// ERROR_LOG_WINDOW is how often an error which keeps repeating is
+	// logged. The occurrences in between are summarized.
+	ERROR_LOG_WINDOW      = "CALICO_BGP_ERROR_LOG_WINDOW"
+	defaultErrorLogWindow = time.Minute
+
+	// EXPORT_PREFIXES is a comma separated list of additional prefixes
+	// which the export policy accepts, such as aggregates. Each entry is a
+	// prefix optionally followed by a mask length range, e.g.
+	// "10.0.0.0/8 16..24" matches the prefixes within 10.0.0.0/8 whose
+	// mask length is from 16 to 24.
+	EXPORT_PREFIXES = "CALICO_BGP_EXPORT_PREFIXES"
+
+	// MESH_ALLOW and MESH_DENY are comma separated lists of node names.
+	// When MESH_ALLOW is set, only the nodes in it are mesh neighbors.
+	// The nodes in MESH_DENY are never mesh neighbors.
+	MESH_ALLOW = "CALICO_BGP_MESH_ALLOW"
+	MESH_DENY  = "CALICO_BGP_MESH_DENY"
+
+	// STATUS_FILE is the path of a JSON file the BGP status is written to
+	// every STATUS_INTERVAL. The file is replaced atomically.
+	STATUS_FILE           = "CALICO_BGP_STATUS_FILE"
+	STATUS_INTERVAL       = "CALICO_BGP_STATUS_INTERVAL"
+	defaultStatusInterval = 10 * time.Second
+
+	// STATUS_STALE_AFTER lists the subsystems which haven't synchronized
+	// with etcd successfully for longer than STATUS_STALE_AFTER as stale
+	// in the status file. The subsystems sync when their configuration
+	// changes, so it should be longer than the configuration usually
+	// stays unchanged.
+	STATUS_STALE_AFTER = "CALICO_BGP_STATUS_STALE_AFTER"
+
+	// DUMP_FILE is the path of a JSON file the neighbor table and the
+	// global and per-neighbor RIBs are written to on SIGUSR1, for bug
+	// reports. The file is replaced atomically.
+	DUMP_FILE = "CALICO_BGP_DUMP_FILE"
+
+	// On SIGUSR2, the advertised prefixes are re-advertised with the
+	// GRACEFUL_SHUTDOWN community and the local AS prepended DRAIN_PREPEND
+	// times, 0 to 255, and withdrawn DRAIN_SETTLE later. Then the daemon
+	// exits.
+	DRAIN_PREPEND        = "CALICO_BGP_DRAIN_PREPEND"
+	DRAIN_SETTLE         = "CALICO_BGP_DRAIN_SETTLE"
+	defaultDrainPrepend  = 3
+	defaultDrainSettle   = 30 * time.Second
+	gracefulShutdownComm = 0xffff0000 // 65535:0 (RFC 8326)
+
+	// When more than CHURN_THRESHOLD BGP configuration changes arrive within
+	// CHURN_WINDOW, handling them is paused for CHURN_COOLDOWN.
+	// The breaker is disabled unless CHURN_THRESHOLD is set.
+	CHURN_THRESHOLD      = "CALICO_BGP_CHURN_THRESHOLD"
+	CHURN_WINDOW         = "CALICO_BGP_CHURN_WINDOW"
+	CHURN_COOLDOWN       = "CALICO_BGP_CHURN_COOLDOWN"
+	defaultChurnWindow   = 10 * time.Second
+	defaultChurnCooldown = 30 * time.Second
+
+	// NEIGHBOR_CONCURRENCY is the number of neighbors added in parallel
+	// at startup
+	NEIGHBOR_CONCURRENCY       = "CALICO_BGP_NEIGHBOR_CONCURRENCY"
+	defaultNeighborConcurrency = 8
+
+	// A neighbor which is not established in QUARANTINE_THRESHOLD
+	// consecutive checks, made every quarantineCheckInterval, is disabled
+	// for QUARANTINE_DURATION and then enabled again to retry.
+	// The quarantine is disabled unless QUARANTINE_THRESHOLD is set.
+	QUARANTINE_THRESHOLD      = "CALICO_BGP_QUARANTINE_THRESHOLD"
+	QUARANTINE_DURATION       = "CALICO_BGP_QUARANTINE_DURATION"
+	defaultQuarantineDuration = 10 * time.Minute
+	quarantineCheckInterval   = 30 * time.Second
+
+	// RECONCILE_INTERVAL enables re-adding the configured neighbors which
+	// are missing from the BGP server, checked every RECONCILE_INTERVAL
+	RECONCILE_INTERVAL = "CALICO_BGP_RECONCILE_INTERVAL"
+
+	// While the file at MAINTENANCE_FILE exists, the changes of the BGP
+	// configuration, the assigned prefixes and the IP pools are held
+	// back, leaving the sessions and the routes as they are. The held
+	// back changes are applied once the file is removed. A pause longer
+	// than the etcd event history restarts the daemon, which then reads
+	// everything again.
+	MAINTENANCE_FILE         = "CALICO_BGP_MAINTENANCE_FILE"
+	maintenanceCheckInterval = 5 * time.Second
+
+	// WITHDRAWN_FILE is the path of a file listing the prefixes, one per
+	// line, which are kept withdrawn whatever the configuration says, read
+	// every withdrawnCheckInterval. A prefix removed from the file, or
+	// every prefix when the file is removed, is advertised again. Empty
+	// lines and lines starting with '#' are ignored.
+	WITHDRAWN_FILE         = "CALICO_BGP_WITHDRAWN_FILE"
+	withdrawnCheckInterval = 5 * time.Second
+
+	// NEIGHBOR_RETRIES is how many times adding or deleting a neighbor is
+	// retried when gobgp fails transiently
+	NEIGHBOR_RETRIES       = "CALICO_BGP_NEIGHBOR_RETRIES"
+	defaultNeighborRetries = 3
+	neighborRetryBackoff   = 200 * time.Millisecond
+
 	aggregatedPrefixSetName = "aggregated"
 	hostPrefixSetName       = "host"
+	poolPrefixSetName       = "pool"
+	originatedPrefixSetName = "originated"
+	aggrPolicyName          = "calico_aggr"
+	originatedPolicyName    = "calico_originated"
+	prependPolicyPrefix     = "calico_prepend_"
 
 	RTPROT_GOBGP = 0x11
 )
 
+var (
+	// prefixCountsMetric maps the address of each neighbor to the numbers
+	// of prefixes received from, accepted from and advertised to it, as of
+	// the last report of logPrefixCounts
+	prefixCountsMetric = expvar.NewMap("calico_bgp_prefix_counts")
+	// neighborsSkippedMetric counts the neighbors skipped because of
+	// MAX_NEIGHBORS
+	neighborsSkippedMetric = expvar.NewInt("calico_bgp_neighbors_skipped")
+	// neighborsQuarantinedMetric is the number of neighbors currently
+	// disabled by QUARANTINE_THRESHOLD
+	neighborsQuarantinedMetric = expvar.NewInt("calico_bgp_neighbors_quarantined")
+)
+
 // VERSION is filled out during the build process (using git describe output)
 var VERSION string
 
+// normalizeAddress returns the canonical form of the IP address 'addr', so
+// that a neighbor is identified by the same string whichever textual form
+// its address was written in. Invalid addresses are returned as is.
+func normalizeAddress(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
 func underscore(ip string) string {
 	return strings.Map(func(r rune) rune {
 		switch r {
@@ -99,6 +444,20 @@ func getEtcdConfig(cfg *calicoapi.CalicoAPIConfig) (etcd.Config, error) {
 	return config, nil
 }
 
+// checkDatastore verifies that the keys this daemon watches can be read
+// from etcd, so that an unreachable endpoint or missing permissions are
+// reported at startup instead of from one of the watchers.
+func checkDatastore(api etcd.KeysAPI, endpoints []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDialTimeout)
+	defer cancel()
+	for _, key := range []string{CALICO_BGP, CALICO_AGGR, CALICO_IPAM} {
+		if _, err := api.Get(ctx, key, nil); errorButKeyNotFound(err) != nil {
+			return fmt.Errorf("failed to read %s from etcd (%s): %s", key, strings.Join(endpoints, ","), err)
+		}
+	}
+	return nil
+}
+
 // recursiveNexthopLookup returns bgpNexthop's actual nexthop
 // In GCE environment, the interface address is /32 and the BGP nexthop is
 // off-subnet. This function looks up kernel RIB and returns a nexthop to
@@ -121,6 +480,202 @@ func recursiveNexthopLookup(bgpNexthop net.IP) (net.IP, error) {
 	return bgpNexthop, nil
 }
 
+// getDurationFromEnv returns the duration set in the environment variable
+// 'name', or 'def' when it is unset.
+func getDurationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	return d, nil
+}
+
+// getIntFromEnv returns the integer set in the environment variable 'name',
+// or 'def' when it is unset.
+func getIntFromEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	return i, nil
+}
+
+// staleWatcher is an etcd watcher which retries failed watches, keeping
+// the last known configuration, until they have failed for longer than
+// 'limit' when it is set. The repeated errors go through errorLimiter.
+type staleWatcher struct {
+	etcd.Watcher
+	name     string
+	limit    time.Duration
+	warnOnly bool
+	errors   *errorLimiter
+	// retryWait is the wait before the first retry, doubled up to
+	// maxWatchRetryWait
+	retryWait time.Duration
+}
+
+// newStaleWatcher wraps 'w' with the staleness limit set in the environment
+func newStaleWatcher(name string, w etcd.Watcher) (*staleWatcher, error) {
+	limit, err := getDurationFromEnv(STALE_LIMIT, 0)
+	if err != nil {
+		return nil, err
+	}
+	var warnOnly bool
+	switch action := os.Getenv(STALE_ACTION); action {
+	case "", staleActionExit:
+	case staleActionWarn:
+		warnOnly = true
+	default:
+		return nil, fmt.Errorf("invalid %s: %s", STALE_ACTION, action)
+	}
+	errors, err := newErrorLimiter()
+	if err != nil {
+		return nil, err
+	}
+	return &staleWatcher{Watcher: w, name: name, limit: limit, warnOnly: warnOnly, errors: errors, retryWait: watchRetryWait}, nil
+}
+
+func (w *staleWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	var since time.Time
+	wait := w.retryWait
+	for {
+		res, err := w.Watcher.Next(ctx)
+		if err == nil {
+			w.errors.reset(fmt.Sprintf("%s watch recovered", w.name))
+			return res, nil
+		}
+		// the watch can't resume from an index etcd no longer has
+		if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeEventIndexCleared {
+			return nil, err
+		}
+		if since.IsZero() {
+			since = time.Now()
+		}
+		if stale := time.Since(since); w.limit <= 0 || stale <= w.limit {
+			w.errors.log(log.Warnf, fmt.Sprintf("%s watch failed, keeping the last known configuration: %s", w.name, err))
+		} else if w.warnOnly {
+			w.errors.log(log.Errorf, fmt.Sprintf("%s watch has been failing since %s: %s", w.name, since.Format(time.RFC3339), err))
+		} else {
+			return nil, fmt.Errorf("%s watch has been failing for more than %s: %s", w.name, w.limit, err)
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > maxWatchRetryWait {
+			wait = maxWatchRetryWait
+		}
+	}
+}
+
+// errorLimiter logs an error message which keeps repeating at most once
+// per 'window', with the number of occurrences since it was last logged
+type errorLimiter struct {
+	window time.Duration
+	msg    string
+	logged time.Time
+	count  int
+}
+
+// newErrorLimiter returns an errorLimiter with the window set in the
+// environment
+func newErrorLimiter() (*errorLimiter, error) {
+	window, err := getDurationFromEnv(ERROR_LOG_WINDOW, defaultErrorLogWindow)
+	if err != nil {
+		return nil, err
+	}
+	return &errorLimiter{window: window}, nil
+}
+
+// log logs 'msg' with 'logf' unless it is the same as the last message and
+// was logged within the window
+func (l *errorLimiter) log(logf func(string, ...interface{}), msg string) {
+	now := time.Now()
+	if msg != l.msg {
+		l.msg, l.logged, l.count = msg, now, 0
+		logf("%s", msg)
+		return
+	}
+	l.count++
+	if now.Sub(l.logged) >= l.window {
+		logf("still failing (%d occurrences): %s", l.count, msg)
+		l.logged, l.count = now, 0
+	}
+}
+
+// reset forgets the last message, logging 'recovered' if there was one
+func (l *errorLimiter) reset(recovered string) {
+	if l.msg == "" {
+		return
+	}
+	log.Print(recovered)
+	l.msg, l.count = "", 0
+}
+
+// syncStatus records when each subsystem last synchronized with etcd
+// successfully. The subsystems are driven by etcd watches, so the time
+// also tells how long a subsystem has been quiet.
+type syncStatus struct {
+	mu   sync.RWMutex
+	last map[string]time.Time
+	// disabled are the subsystems which don't run on this node, so that
+	// they never sync and are never stale
+	disabled map[string]bool
+}
+
+// syncSubsystems are the names the subsystems mark their syncs with
+var syncSubsystems = []string{"bgpconfig", "ipam", "prefix"}
+
+func newSyncStatus() *syncStatus {
+	return &syncStatus{last: make(map[string]time.Time), disabled: make(map[string]bool)}
+}
+
+// disable excludes the subsystem 'name' from the stale ones
+func (st *syncStatus) disable(name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.disabled[name] = true
+}
+
+func (st *syncStatus) markSynced(name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.last[name] = time.Now()
+}
+
+// snapshot returns a copy of the times each subsystem last synchronized
+func (st *syncStatus) snapshot() map[string]time.Time {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	m := make(map[string]time.Time, len(st.last))
+	for name, t := range st.last {
+		m[name] = t
+	}
+	return m
+}
+
+// stale returns the subsystems among 'names' which haven't synchronized
+// successfully within 'limit'
+func (st *syncStatus) stale(names []string, limit time.Duration) []string {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	var ret []string
+	for _, name := range names {
+		if st.disabled[name] {
+			continue
+		}
+		if t, ok := st.last[name]; !ok || time.Since(t) > limit {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
 func cleanUpRoutes() error {
 	filter := &netlink.Route{
 		Protocol: RTPROT_GOBGP,
@@ -148,6 +703,136 @@ type Server struct {
 	ipv6      net.IP
 	ipam      *ipamCache
 	reloadCh  chan []*bgptable.Path
+	// summarizer, set when SUMMARIZE_POOLS is enabled, advertises the
+	// pools covered by the blocks of this node instead of the blocks
+	summarizer *poolSummarizer
+	loopback   net.IP
+	families   []bgpconfig.AfiSafiType
+	// observeOnly disables every change to the BGP server and kernel routes
+	observeOnly bool
+	// exportPoolsOnly rejects exported prefixes outside the enabled pools
+	exportPoolsOnly bool
+	// exportLearned allows the routes learned from peers to be exported
+	exportLearned bool
+	// neighborRetries is the number of retries of AddNeighbor and
+	// DeleteNeighbor
+	neighborRetries int
+	// maxNeighbors is the maximum number of neighbors; zero is unlimited.
+	// neighborMu serializes adding neighbors while it is enforced.
+	maxNeighbors int
+	neighborMu   sync.Mutex
+	// origin is the ORIGIN attribute of the paths made by makePath
+	origin uint8
+	// med is the MED of the paths made by makePath unless medOverrides
+	// has their prefix. nil leaves MED unset.
+	med          *uint32
+	medOverrides map[string]uint32
+	// nodeCommunity is the large community identifying this node attached
+	// to the paths made by makePath. nil leaves it unset.
+	nodeCommunity *bgp.LargeCommunity
+	// staleTime is the long-lived graceful restart stale time in seconds.
+	// Zero disables graceful restart.
+	staleTime uint32
+	// mrai is the minimum route advertisement interval in seconds of the
+	// neighbors. Zero leaves gobgp's default.
+	mrai float64
+	// vrf is the VRF the assigned prefixes are advertised in. Empty means
+	// the global table.
+	vrf string
+	// ipv6ASN is the AS of the IPv6 sessions; zero means the node's AS
+	ipv6ASN numorstring.ASNumber
+	// used when the global AS number or node_mesh is not set in etcd
+	defaultASN  numorstring.ASNumber
+	defaultMesh meshConfig
+	// asnSources is the order in which getPeerASN tries the sources of an
+	// AS number
+	asnSources []string
+	status     *syncStatus
+	// maintenanceWait is how often waitMaintenance checks whether the
+	// maintenance file has been removed
+	maintenanceWait time.Duration
+	// neighbors, if set, replaces the lookup of the neighbors and the
+	// state of their sessions in gobgp
+	neighbors func(addr string) []*bgpconfig.Neighbor
+	// prependMu guards prependPolicies, the names of the AS-path prepend
+	// export policies added
+	prependMu       sync.Mutex
+	prependPolicies map[string]bool
+	// hostnameMu guards hostnamePeers, the neighbors of the peers given
+	// by hostname, keyed by the hostname
+	hostnameMu    sync.Mutex
+	hostnamePeers map[string]*bgpconfig.Neighbor
+	// lookupIP, if set, replaces the DNS lookup of the peers given by
+	// hostname
+	lookupIP func(host string) ([]net.IP, error)
+	// linkLocalNeighbor, if set, replaces the discovery of the link-local
+	// address of the router on an interface of an unnumbered neighbor
+	linkLocalNeighbor func(iface string) (string, error)
+	// pathSetMu guards pathSets, the paths originated from the
+	// configuration, grouped by name so that a group can be withdrawn
+	pathSetMu sync.Mutex
+	pathSets  map[string][]*bgptable.Path
+	// withdrawnMu guards withdrawn, the prefixes withdrawn by
+	// WithdrawPrefix. Each holds the path which would be advertised
+	// otherwise, if any.
+	withdrawnMu sync.Mutex
+	withdrawn   map[string]*suppressedPath
+	// pathIDMu guards pathIDs, the identifiers AddPath returned for the
+	// paths advertised by addPath, so that they are withdrawn by
+	// DeletePath
+	pathIDMu sync.Mutex
+	pathIDs  map[pathKey][]byte
+	// observedMu guards observed, the number of operations of each kind
+	// skipped in observe-only mode
+	observedMu sync.Mutex
+	observed   map[string]int
+}
+
+// pathKey identifies an advertised prefix in the RIB of a VRF
+type pathKey struct {
+	vrf    string
+	prefix string
+}
+
+// suppressedPath is a path kept from being advertised by WithdrawPrefix
+type suppressedPath struct {
+	vrf  string
+	path *bgptable.Path
+}
+
+// nodeAddresses returns the BGP addresses of the node 'spec', or the ones
+// set in IPV4_ADDRESS and IPV6_ADDRESS instead
+func nodeAddresses(spec *calicoapi.NodeBGPSpec) (net.IP, net.IP) {
+	var ipv4, ipv6 net.IP
+	if ipnet := spec.IPv4Address; ipnet != nil {
+		ipv4 = ipnet.IP
+	}
+	if ipnet := spec.IPv6Address; ipnet != nil {
+		ipv6 = ipnet.IP
+	}
+	if ip := getAddressOverride(IPV4_ADDRESS, true); ip != nil {
+		ipv4 = ip
+	}
+	if ip := getAddressOverride(IPV6_ADDRESS, false); ip != nil {
+		ipv6 = ip
+	}
+	return ipv4, ipv6
+}
+
+// getAddressOverride returns the address set in the environment variable
+// 'name'. An invalid address is logged and ignored.
+func getAddressOverride(name string, v4 bool) net.IP {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	ip := net.ParseIP(v)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		log.Warnf("ignore invalid %s: %s", name, v)
+		return nil
+	}
+	log.Printf("use %s as BGP address instead of the node's", ip)
+	return ip
 }
 
 func NewServer() (*Server, error) {
@@ -166,6 +851,9 @@ func NewServer() (*Server, error) {
 		return nil, err
 	}
 	etcdCli := etcd.NewKeysAPI(cli)
+	if err := checkDatastore(etcdCli, etcdConfig.Endpoints); err != nil {
+		return nil, err
+	}
 
 	calicoCli, err := calicocli.New(*config)
 	if err != nil {
@@ -174,29 +862,138 @@ func NewServer() (*Server, error) {
 
 	node, err := calicoCli.Nodes().Get(calicoapi.NodeMetadata{Name: os.Getenv(NODENAME)})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get node %q: %s", os.Getenv(NODENAME), err)
 	}
 
 	if node.Spec.BGP == nil {
 		return nil, fmt.Errorf("Calico is running in policy-only mode")
 	}
-	var ipv4, ipv6 net.IP
-	if ipnet := node.Spec.BGP.IPv4Address; ipnet != nil {
-		ipv4 = ipnet.IP
+	ipv4, ipv6 := nodeAddresses(node.Spec.BGP)
+
+	var loopback net.IP
+	if v := os.Getenv(LOOPBACK_ADDRESS); v != "" {
+		if loopback = net.ParseIP(v); loopback == nil {
+			return nil, fmt.Errorf("invalid %s: %s", LOOPBACK_ADDRESS, v)
+		}
 	}
-	if ipnet := node.Spec.BGP.IPv6Address; ipnet != nil {
-		ipv6 = ipnet.IP
+
+	var families []bgpconfig.AfiSafiType
+	for _, name := range strings.Split(os.Getenv(FAMILIES), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f := bgpconfig.AfiSafiType(name)
+		if err := f.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", FAMILIES, err)
+		}
+		families = append(families, f)
+	}
+
+	observeOnly := false
+	if v := os.Getenv(OBSERVE_ONLY); v != "" {
+		if observeOnly, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", OBSERVE_ONLY, err)
+		}
+	}
+
+	exportPoolsOnly := false
+	if v := os.Getenv(EXPORT_POOLS_ONLY); v != "" {
+		if exportPoolsOnly, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", EXPORT_POOLS_ONLY, err)
+		}
+	}
+
+	exportLearned := false
+	if v := os.Getenv(EXPORT_LEARNED_ROUTES); v != "" {
+		if exportLearned, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", EXPORT_LEARNED_ROUTES, err)
+		}
+	}
+
+	neighborRetries, err := getIntFromEnv(NEIGHBOR_RETRIES, defaultNeighborRetries)
+	if err != nil {
+		return nil, err
+	}
+
+	maxNeighbors, err := getIntFromEnv(MAX_NEIGHBORS, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipv6ASN numorstring.ASNumber
+	if v := os.Getenv(IPV6_AS); v != "" {
+		if ipv6ASN, err = numorstring.ASNumberFromString(v); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", IPV6_AS, err)
+		}
+	}
+
+	origin, err := parseOrigin(os.Getenv(ORIGIN))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", ORIGIN, err)
+	}
+
+	med, medOverrides, err := getMEDConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	mrai, err := getDurationFromEnv(MRAI, 0)
+	if err != nil {
+		return nil, err
+	}
+	if mrai < 0 {
+		return nil, fmt.Errorf("invalid %s: %s", MRAI, mrai)
+	}
+
+	nodeCommunity, err := getNodeCommunity()
+	if err != nil {
+		return nil, err
+	}
+
+	staleTime, err := getStaleTime()
+	if err != nil {
+		return nil, err
+	}
+
+	defaultASN, defaultMesh, err := getDefaults()
+	if err != nil {
+		return nil, err
+	}
+	asnSources, err := getASNPrecedence()
+	if err != nil {
+		return nil, err
 	}
 
 	bgpServer := bgpserver.NewBgpServer()
 
 	return &Server{
-		bgpServer: bgpServer,
-		client:    calicoCli,
-		etcd:      etcdCli,
-		ipv4:      ipv4,
-		ipv6:      ipv6,
-		reloadCh:  make(chan []*bgptable.Path),
+		bgpServer:       bgpServer,
+		client:          calicoCli,
+		etcd:            etcdCli,
+		ipv4:            ipv4,
+		ipv6:            ipv6,
+		reloadCh:        make(chan []*bgptable.Path),
+		loopback:        loopback,
+		families:        families,
+		observeOnly:     observeOnly,
+		exportPoolsOnly: exportPoolsOnly,
+		exportLearned:   exportLearned,
+		neighborRetries: neighborRetries,
+		maxNeighbors:    maxNeighbors,
+		ipv6ASN:         ipv6ASN,
+		origin:          origin,
+		med:             med,
+		medOverrides:    medOverrides,
+		nodeCommunity:   nodeCommunity,
+		staleTime:       staleTime,
+		mrai:            mrai.Seconds(),
+		vrf:             os.Getenv(VRF),
+		defaultASN:      defaultASN,
+		asnSources:      asnSources,
+		defaultMesh:     defaultMesh,
+		status:          newSyncStatus(),
+		maintenanceWait: maintenanceCheckInterval,
 	}, nil
 }
 
@@ -206,15 +1003,27 @@ func (s *Server) Serve() {
 		return nil
 	})
 
-	bgpAPIServer := bgpapi.NewGrpcServer(s.bgpServer, ":50051")
-	s.t.Go(bgpAPIServer.Serve)
+	if !s.observeOnly {
+		bgpAPIServer := bgpapi.NewGrpcServer(s.bgpServer, ":50051")
+		s.t.Go(bgpAPIServer.Serve)
+	}
 
-	globalConfig, err := s.getGlobalConfig()
+	asn, err := s.getNodeASN()
 	if err != nil {
 		log.Fatal(err)
 	}
+	port, err := getIntFromEnv(LISTEN_PORT, bgp.BGP_PORT)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.observeOnly {
+		// no peer can connect
+		port = -1
+	}
 
-	if err := s.bgpServer.Start(globalConfig); err != nil {
+	// the global configuration must be set before any neighbor or path
+	// is added, so this precedes all the watchers below
+	if err := s.startBGP(asn, s.ipv4, int32(port)); err != nil {
 		log.Fatal("failed to start BGP server:", err)
 	}
 
@@ -222,58 +1031,210 @@ func (s *Server) Serve() {
 		log.Fatal(err)
 	}
 
-	s.ipam = newIPAMCache(s.etcd, s.ipamUpdateHandler)
-	// sync IPAM and call ipamUpdateHandler
-	s.t.Go(func() error { return fmt.Errorf("syncIPAM: %s", s.ipam.sync()) })
-	// watch routes from other BGP peers and update FIB
-	s.t.Go(func() error { return fmt.Errorf("watchBGPPath: %s", s.watchBGPPath()) })
-	// watch prefix assigned and announce to other BGP peers
-	s.t.Go(func() error { return fmt.Errorf("watchPrefix: %s", s.watchPrefix()) })
-	// watch BGP configuration
-	s.t.Go(func() error { return fmt.Errorf("watchBGPConfig: %s", s.watchBGPConfig()) })
-	// watch routes added by kernel and announce to other BGP peers
-	s.t.Go(func() error { return fmt.Errorf("watchKernelRoute: %s", s.watchKernelRoute()) })
+	if url := os.Getenv(ZEBRA_URL); url != "" && !s.observeOnly {
+		if err := s.startZebra(url); err != nil {
+			log.Fatal("failed to connect to zebra:", err)
+		}
+	}
 
-	<-s.t.Dying()
+	if s.vrf != "" {
+		if err := s.addVRF(); err != nil {
+			log.Fatal("failed to add VRF:", err)
+		}
+	}
 
-	if err := cleanUpRoutes(); err != nil {
-		log.Fatalf("%s, also failed to clean up routes which we injected: %s", s.t.Err(), err)
+	if s.loopback != nil {
+		if err := s.advertiseLoopback(); err != nil {
+			log.Fatal(err)
+		}
 	}
-	log.Fatal(s.t.Err())
 
-}
+	if v := os.Getenv(ANYCAST_ADDRESSES); v != "" {
+		if err := s.advertiseAnycast(strings.Split(v, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-func isCrossSubnet(gw net.IP, subnet net.IPNet) bool {
-	p := &ipPool{CIDR: subnet.String()}
-	result := !p.contain(gw.String() + "/32")
-	return result
-}
+	if v := os.Getenv(BLACKHOLE_PREFIXES); v != "" {
+		if err := s.advertiseBlackholes(strings.Split(v, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-func (s *Server) ipamUpdateHandler(pool *ipPool) error {
-	filter := &netlink.Route{
-		Protocol: RTPROT_GOBGP,
+	if v := os.Getenv(CANARY_PREFIXES); v != "" {
+		if err := s.advertiseCanaries(strings.Split(v, ",")); err != nil {
+			log.Fatal(err)
+		}
+		s.t.Go(s.watchCanarySignal)
 	}
-	list, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_PROTOCOL)
-	if err != nil {
-		return err
+
+	if v := os.Getenv(ADVERTISE_DEFAULT_ROUTE); v != "" {
+		if enabled, err := strconv.ParseBool(v); err != nil {
+			log.Fatalf("invalid %s: %s", ADVERTISE_DEFAULT_ROUTE, err)
+		} else if enabled {
+			if err := s.advertiseDefaultRoutes(); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
-	node, err := s.client.Nodes().Get(calicoapi.NodeMetadata{Name: os.Getenv(NODENAME)})
+
+	establishedWait, err := getDurationFromEnv(ESTABLISHED_WAIT, 0)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
 
-	for _, route := range list {
-		if route.Dst == nil {
-			continue
+	if v := os.Getenv(SUMMARIZE_POOLS); v != "" {
+		if enabled, err := strconv.ParseBool(v); err != nil {
+			log.Fatalf("invalid %s: %s", SUMMARIZE_POOLS, err)
+		} else if enabled {
+			s.summarizer = newPoolSummarizer(s)
 		}
-		prefix := route.Dst.String()
-		if pool.contain(prefix) {
-			ipip := pool.IPIP != ""
-			if pool.Mode == "cross-subnet" && !isCrossSubnet(route.Gw, node.Spec.BGP.IPv4Address.Network().IPNet) {
-				ipip = false
-			}
+	}
+
+	s.ipam = newIPAMCache(s.etcd, s.ipamUpdateHandler)
+	if s.summarizer != nil {
+		s.ipam.updateHandlers = append(s.ipam.updateHandlers, s.summarizePool)
+	}
+	if s.exportPoolsOnly {
+		s.ipam.updateHandlers = append(s.ipam.updateHandlers, func(*ipPool) error { return s.updatePoolPrefixSet() })
+	}
+	s.ipam.syncHandler = func() { s.status.markSynced("ipam") }
+	s.ipam.pause = func() { s.waitMaintenance("ipam") }
+	// sync IPAM and call ipamUpdateHandler
+	s.t.Go(func() error { return fmt.Errorf("syncIPAM: %s", s.ipam.sync()) })
+	// watch routes from other BGP peers and update FIB
+	s.t.Go(func() error { return fmt.Errorf("watchBGPPath: %s", s.watchBGPPath()) })
+	// watch prefix assigned and announce to other BGP peers
+	if advertise, err := s.getAdvertiseBlocks(); err != nil {
+		log.Fatal(err)
+	} else if advertise {
+		s.t.Go(func() error { return fmt.Errorf("watchPrefix: %s", s.watchPrefix(establishedWait)) })
+	} else {
+		log.Printf("advertise_blocks is false. the blocks of this node are not advertised")
+		s.status.disable("prefix")
+	}
+	// watch BGP configuration
+	s.t.Go(func() error { return fmt.Errorf("watchBGPConfig: %s", s.watchBGPConfig()) })
+	// watch routes added by kernel and announce to other BGP peers
+	s.t.Go(func() error { return fmt.Errorf("watchKernelRoute: %s", s.watchKernelRoute()) })
+	// report the number of prefixes exchanged with each neighbor
+	if interval, err := getDurationFromEnv(PREFIX_COUNT_INTERVAL, defaultPrefixCountInterval); err != nil {
+		log.Fatal(err)
+	} else if interval > 0 {
+		s.t.Go(func() error { return s.logPrefixCounts(interval) })
+	}
+	if addr := os.Getenv(METRICS_ADDR); addr != "" {
+		s.t.Go(func() error { return s.serveMetrics(addr) })
+	}
+	// disable neighbors which fail to establish for a while
+	if threshold, err := getIntFromEnv(QUARANTINE_THRESHOLD, 0); err != nil {
+		log.Fatal(err)
+	} else if duration, err := getDurationFromEnv(QUARANTINE_DURATION, defaultQuarantineDuration); err != nil {
+		log.Fatal(err)
+	} else if threshold > 0 {
+		s.t.Go(func() error { return s.quarantineNeighbors(threshold, duration) })
+	}
+	// re-add the neighbors the BGP server has lost
+	if interval, err := getDurationFromEnv(RECONCILE_INTERVAL, 0); err != nil {
+		log.Fatal(err)
+	} else if interval > 0 && !s.observeOnly {
+		s.t.Go(func() error { return s.reconcileNeighbors(interval) })
+	}
+	// dump the derived configuration on SIGUSR1
+	s.t.Go(s.watchDumpSignal)
+	// follow the addresses of the peers given by hostname
+	if interval, err := getDurationFromEnv(RESOLVE_INTERVAL, 0); err != nil {
+		log.Fatal(err)
+	} else if interval > 0 {
+		s.t.Go(func() error { return s.resolveHostnamePeers(interval) })
+	}
+	// drain the advertised prefixes on SIGUSR2
+	if prepend, err := getDrainPrepend(); err != nil {
+		log.Fatal(err)
+	} else if settle, err := getDurationFromEnv(DRAIN_SETTLE, defaultDrainSettle); err != nil {
+		log.Fatal(err)
+	} else {
+		s.t.Go(func() error { return s.watchDrainSignal(prepend, settle) })
+	}
+	// follow the changes of the static neighbors file
+	if path := os.Getenv(STATIC_NEIGHBORS_FILE); path != "" {
+		s.t.Go(func() error { return s.watchStaticNeighborsFile(path) })
+	}
+	// keep the prefixes listed in a file withdrawn
+	if path := os.Getenv(WITHDRAWN_FILE); path != "" {
+		s.t.Go(func() error { return s.watchWithdrawnFile(path) })
+	}
+	// write the status for sidecars
+	if path := os.Getenv(STATUS_FILE); path != "" {
+		if interval, err := getDurationFromEnv(STATUS_INTERVAL, defaultStatusInterval); err != nil {
+			log.Fatal(err)
+		} else if staleAfter, err := getDurationFromEnv(STATUS_STALE_AFTER, 0); err != nil {
+			log.Fatal(err)
+		} else {
+			s.t.Go(func() error { return s.writeStatusFile(path, interval, staleAfter) })
+		}
+	}
+
+	<-s.t.Dying()
+
+	if s.observeOnly {
+		log.Fatal(s.t.Err())
+	}
+	if err := cleanUpRoutes(); err != nil {
+		log.Fatalf("%s, also failed to clean up routes which we injected: %s", s.t.Err(), err)
+	}
+	log.Fatal(s.t.Err())
+
+}
+
+func isCrossSubnet(gw net.IP, subnet net.IPNet) bool {
+	p := &ipPool{CIDR: subnet.String()}
+	result := !p.contain(gw.String() + "/32")
+	return result
+}
+
+// needsIPIP returns true if a route to 'gw' for a prefix within 'pool' must
+// go through the IPIP tunnel. 'subnet' is the subnet of this node.
+func needsIPIP(pool *ipPool, gw net.IP, subnet net.IPNet) bool {
+	switch pool.ipipMode() {
+	case ipipModeAlways:
+		return true
+	case ipipModeCrossSubnet:
+		return isCrossSubnet(gw, subnet)
+	}
+	return false
+}
+
+// ipamUpdateHandler is called when 'pool' is added, changed or deleted.
+// The kernel routes within the pool are re-derived from the pool which
+// matches them now, since a more specific pool may have been added or the
+// pool which used to match them may have been deleted.
+func (s *Server) ipamUpdateHandler(pool *ipPool) error {
+	if s.observeOnly {
+		return nil
+	}
+	filter := &netlink.Route{
+		Protocol: RTPROT_GOBGP,
+	}
+	list, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return err
+	}
+	node, err := s.client.Nodes().Get(calicoapi.NodeMetadata{Name: os.Getenv(NODENAME)})
+	if err != nil {
+		return err
+	}
+
+	for _, route := range list {
+		if route.Dst == nil {
+			continue
+		}
+		prefix := route.Dst.String()
+		if pool.contain(prefix) {
+			p := s.ipam.match(prefix)
+			ipip := p != nil && needsIPIP(p, route.Gw, node.Spec.BGP.IPv4Address.Network().IPNet)
 			if ipip {
-				i, err := net.InterfaceByName(pool.IPIP)
+				i, err := net.InterfaceByName(p.IPIP)
 				if err != nil {
 					return err
 				}
@@ -303,9 +1264,12 @@ func (s *Server) ipamUpdateHandler(pool *ipPool) error {
 					return err
 				}
 				route.Gw = gw
+				route.LinkIndex = 0
 				route.Flags = 0
 			}
-			return netlink.RouteReplace(&route)
+			if err := netlink.RouteReplace(&route); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -321,357 +1285,2059 @@ func (s *Server) getPeerASN(host string) (numorstring.ASNumber, error) {
 		return 0, err
 	}
 	if node.Spec.BGP == nil {
-		return 0, fmt.Errorf("host %s is running in policy-only mode")
+		return 0, fmt.Errorf("host %s is running in policy-only mode", host)
+	}
+	asn, ok, err := s.resolveASN(host)
+	if err != nil {
+		return 0, err
 	}
-	asn := node.Spec.BGP.ASNumber
-	if asn == nil {
-		return s.client.Config().GetGlobalASNumber()
+	if !ok {
+		return 0, fmt.Errorf("no AS number is set for %s in %s", host, strings.Join(s.asnSources, ", "))
 	}
-	return *asn, nil
+	return asn, nil
+}
 
+// resolveASN returns the AS number of 'host' from the first source in
+// s.asnSources which sets it. It returns false when none does. The mesh
+// neighbors and getPeerASN all resolve AS numbers with it, so that they
+// agree.
+func (s *Server) resolveASN(host string) (numorstring.ASNumber, bool, error) {
+	for _, source := range s.asnSources {
+		var asn numorstring.ASNumber
+		var ok bool
+		var err error
+		switch source {
+		case "node":
+			asn, ok, err = s.getASN(fmt.Sprintf("%s/host/%s/as_num", CALICO_BGP, host))
+		case "global":
+			asn, ok, err = s.getASN(fmt.Sprintf("%s/global/as_num", CALICO_BGP))
+		case "default":
+			asn, ok = s.defaultASN, true
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			log.Debugf("AS number of %s: %d (%s)", host, asn, source)
+			return asn, true, nil
+		}
+	}
+	return 0, false, nil
 }
 
-func (s *Server) getGlobalConfig() (*bgpconfig.Global, error) {
-	asn, err := s.getNodeASN()
+// getASN returns the AS number in the etcd key 'key'. It returns false
+// when it is not set or invalid, so that the next source is tried.
+func (s *Server) getASN(key string) (numorstring.ASNumber, bool, error) {
+	res, err := s.etcd.Get(context.Background(), key, nil)
 	if err != nil {
-		return nil, err
+		if errorButKeyNotFound(err) == nil {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	asn, err := numorstring.ASNumberFromString(res.Node.Value)
+	if err != nil {
+		log.Warnf("invalid AS number %q in %s: %s", res.Node.Value, key, err)
+		return 0, false, nil
 	}
-	return &bgpconfig.Global{
+	return asn, true, nil
+}
+
+// getDefaults returns the AS number and the mesh state used when they are
+// not set in etcd
+func getDefaults() (numorstring.ASNumber, meshConfig, error) {
+	asn := numorstring.ASNumber(defaultGlobalASN)
+	mesh := meshConfig{Enabled: true}
+	var err error
+	if v := os.Getenv(DEFAULT_AS); v != "" {
+		if asn, err = numorstring.ASNumberFromString(v); err != nil {
+			return 0, mesh, fmt.Errorf("invalid %s: %s", DEFAULT_AS, err)
+		}
+	}
+	if v := os.Getenv(DEFAULT_NODE_MESH); v != "" {
+		if mesh.Enabled, err = strconv.ParseBool(v); err != nil {
+			return 0, mesh, fmt.Errorf("invalid %s: %s", DEFAULT_NODE_MESH, err)
+		}
+	}
+	return asn, mesh, nil
+}
+
+// getASNPrecedence returns the sources of AS numbers in the order set in
+// the environment
+func getASNPrecedence() ([]string, error) {
+	v := os.Getenv(ASN_PRECEDENCE)
+	if v == "" {
+		v = defaultASNPrecedence
+	}
+	var sources []string
+	for _, source := range strings.Split(v, ",") {
+		source = strings.TrimSpace(source)
+		switch source {
+		case "node", "global", "default":
+			sources = append(sources, source)
+		case "":
+		default:
+			return nil, fmt.Errorf("invalid %s: unknown source %q", ASN_PRECEDENCE, source)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("invalid %s: no source", ASN_PRECEDENCE)
+	}
+	return sources, nil
+}
+
+// getAdvertiseBlocks returns false when
+// /calico/bgp/v1/host/$NODENAME/advertise_blocks is "false", for nodes like
+// dedicated route reflectors which peer without advertising the blocks
+// assigned to them. A change of the key restarts the daemon like any other
+// local host config update.
+func (s *Server) getAdvertiseBlocks() (bool, error) {
+	res, err := s.etcd.Get(context.Background(), fmt.Sprintf("%s/host/%s/advertise_blocks", CALICO_BGP, os.Getenv(NODENAME)), nil)
+	if err != nil {
+		if errorButKeyNotFound(err) == nil {
+			return true, nil
+		}
+		return false, err
+	}
+	advertise, err := strconv.ParseBool(res.Node.Value)
+	if err != nil {
+		return false, fmt.Errorf("invalid advertise_blocks: %s", err)
+	}
+	return advertise, nil
+}
+
+// startBGP starts the BGP server with the global configuration
+func (s *Server) startBGP(asn numorstring.ASNumber, routerID net.IP, listenPort int32) error {
+	confed, err := getConfederationConfig()
+	if err != nil {
+		return err
+	}
+	return s.bgpServer.Start(&bgpconfig.Global{
 		Config: bgpconfig.GlobalConfig{
 			As:       uint32(asn),
-			RouterId: s.ipv4.String(),
+			RouterId: routerID.String(),
+			Port:     listenPort,
 		},
-	}, nil
+		Confederation: confed,
+	})
 }
 
-func (s *Server) isMeshMode() (bool, error) {
-	return s.client.Config().GetNodeToNodeMesh()
+// startZebra connects the BGP server to zebra at url with the API version
+// and the redistributed route types set in the environment
+func (s *Server) startZebra(url string) error {
+	c, err := zebraConfig(url)
+	if err != nil {
+		return err
+	}
+	log.Printf("connect to zebra at %s (version %d)", url, c.Version)
+	return s.bgpServer.StartZebraClient(c)
 }
 
-// getMeshNeighborConfigs returns the list of mesh BGP neighbor configuration struct
-func (s *Server) getMeshNeighborConfigs() ([]*bgpconfig.Neighbor, error) {
-	globalASN, err := s.getNodeASN()
+// zebraConfig returns the configuration of the zebra client connecting to
+// url, with the API version and the redistributed route types set in the
+// environment
+func zebraConfig(url string) (*bgpconfig.ZebraConfig, error) {
+	version, err := getIntFromEnv(ZEBRA_VERSION, defaultZebraVersion)
 	if err != nil {
 		return nil, err
 	}
-	nodes, err := s.client.Nodes().List(calicoapi.NodeMetadata{})
+	if version <= 0 || version > math.MaxUint8 {
+		return nil, fmt.Errorf("invalid %s: %d is out of the range 1-%d", ZEBRA_VERSION, version, math.MaxUint8)
+	}
+	var types []bgpconfig.InstallProtocolType
+	for _, v := range strings.Split(os.Getenv(ZEBRA_REDISTRIBUTE), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			types = append(types, bgpconfig.InstallProtocolType(v))
+		}
+	}
+	return &bgpconfig.ZebraConfig{
+		Enabled:                   true,
+		Url:                       url,
+		RedistributeRouteTypeList: types,
+		Version:                   uint8(version),
+	}, nil
+}
+
+// addVRF adds s.vrf to the BGP server with the route distinguisher and
+// route targets set in the environment
+func (s *Server) addVRF() error {
+	rd, err := bgp.ParseRouteDistinguisher(os.Getenv(VRF_RD))
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("invalid %s: %s", VRF_RD, err)
 	}
-	ns := make([]*bgpconfig.Neighbor, 0, len(nodes.Items))
-	for _, node := range nodes.Items {
-		if node.Metadata.Name == os.Getenv(NODENAME) {
+	var rts []bgp.ExtendedCommunityInterface
+	for _, v := range strings.Split(os.Getenv(VRF_RT), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
 			continue
 		}
-		peerASN := globalASN
-		spec := node.Spec.BGP
-		if spec == nil {
-			continue
+		rt, err := bgp.ParseRouteTarget(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", VRF_RT, err)
 		}
+		rts = append(rts, rt)
+	}
+	if len(rts) == 0 {
+		return fmt.Errorf("%s is required with %s", VRF_RT, VRF)
+	}
+	log.Printf("add VRF %s (RD %s)", s.vrf, rd)
+	return s.bgpServer.AddVrf(s.vrf, 0, rd, rts, rts)
+}
 
-		asn := spec.ASNumber
-		if asn != nil {
-			peerASN = *asn
-		}
-		if v4 := spec.IPv4Address; v4 != nil {
-			ip := v4.IP.String()
-			id := strings.Replace(ip, ".", "_", -1)
-			ns = append(ns, &bgpconfig.Neighbor{
-				Config: bgpconfig.NeighborConfig{
-					NeighborAddress: ip,
-					PeerAs:          uint32(peerASN),
-					Description:     fmt.Sprintf("Mesh_%s", id),
-				},
-			})
+// getConfederationConfig returns the confederation configuration set in
+// the environment. The confederation is disabled when CONFEDERATION_ID is
+// not set.
+func getConfederationConfig() (bgpconfig.Confederation, error) {
+	var c bgpconfig.Confederation
+	id := os.Getenv(CONFEDERATION_ID)
+	if id == "" {
+		return c, nil
+	}
+	asn, err := numorstring.ASNumberFromString(id)
+	if err != nil {
+		return c, fmt.Errorf("invalid %s: %s", CONFEDERATION_ID, err)
+	}
+	c.Config.Enabled = true
+	c.Config.Identifier = uint32(asn)
+	for _, member := range strings.Split(os.Getenv(CONFEDERATION_MEMBERS), ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
 		}
-		if v6 := spec.IPv6Address; v6 != nil {
-			ip := v6.IP.String()
-			id := strings.Replace(ip, ":", "_", -1)
-			ns = append(ns, &bgpconfig.Neighbor{
-				Config: bgpconfig.NeighborConfig{
-					NeighborAddress: ip,
-					PeerAs:          uint32(peerASN),
-					Description:     fmt.Sprintf("Mesh_%s", id),
-				},
-			})
+		asn, err := numorstring.ASNumberFromString(member)
+		if err != nil {
+			return c, fmt.Errorf("invalid %s: %s", CONFEDERATION_MEMBERS, err)
 		}
+		c.Config.MemberAsList = append(c.Config.MemberAsList, uint32(asn))
 	}
-	return ns, nil
+	return c, nil
+}
 
+// meshConfig is the value stored in /calico/bgp/v1/global/node_mesh.
+// IPv4 and IPv6 optionally override Enabled for a single address family,
+// e.g. {"enabled": true, "ipv6": false} meshes over IPv4 only.
+// The plain {"enabled": true} form enables the mesh for both families.
+type meshConfig struct {
+	Enabled bool  `json:"enabled"`
+	IPv4    *bool `json:"ipv4,omitempty"`
+	IPv6    *bool `json:"ipv6,omitempty"`
 }
 
-// getNeighborConfigFromPeer returns a BGP neighbor configuration struct from *etcd.Node
-func getNeighborConfigFromPeer(node *etcd.Node, neighborType string) (*bgpconfig.Neighbor, error) {
-	m := &struct {
-		IP  string `json:"ip"`
-		ASN string `json:"as_num"`
-	}{}
-	if err := json.Unmarshal([]byte(node.Value), m); err != nil {
-		return nil, err
+func parseMeshConfig(value string) (*meshConfig, error) {
+	c := &meshConfig{}
+	if err := json.Unmarshal([]byte(value), c); err != nil {
+		return nil, fmt.Errorf("invalid node_mesh value %q: %s", value, err)
 	}
-	asn, err := numorstring.ASNumberFromString(m.ASN)
+	return c, nil
+}
+
+// enabled returns true if the mesh is enabled for the given address family
+func (c *meshConfig) enabled(v4 bool) bool {
+	override := c.IPv6
+	if v4 {
+		override = c.IPv4
+	}
+	if override != nil {
+		return *override
+	}
+	return c.Enabled
+}
+
+func (s *Server) getMeshConfig() (*meshConfig, error) {
+	res, err := s.etcd.Get(context.Background(), fmt.Sprintf("%s/global/node_mesh", CALICO_BGP), nil)
 	if err != nil {
+		if errorButKeyNotFound(err) == nil {
+			c := s.defaultMesh
+			return &c, nil
+		}
 		return nil, err
 	}
-	return &bgpconfig.Neighbor{
-		Config: bgpconfig.NeighborConfig{
-			NeighborAddress: m.IP,
-			PeerAs:          uint32(asn),
-			Description:     fmt.Sprintf("%s_%s", strings.Title(neighborType), underscore(m.IP)),
-		},
-	}, nil
+	return parseMeshConfig(res.Node.Value)
 }
 
-// getNonMeshNeighborConfigs returns the list of non-mesh BGP neighbor configuration struct
-// valid neighborType is either "global" or "node"
-func (s *Server) getNonMeshNeighborConfigs(neighborType string) ([]*bgpconfig.Neighbor, error) {
-	var metadata calicoapi.BGPPeerMetadata
-	switch neighborType {
-	case "global":
-		metadata.Scope = calicoscope.Global
-	case "node":
-		metadata.Scope = calicoscope.Node
-		metadata.Node = os.Getenv(NODENAME)
-	default:
-		return nil, fmt.Errorf("invalid neighbor type: %s", neighborType)
-	}
-	list, err := s.client.BGPPeers().List(metadata)
+// getMeshNeighborConfigs returns the list of mesh BGP neighbor configuration struct
+// for the address families the mesh is enabled for
+func (s *Server) getMeshNeighborConfigs(mesh *meshConfig) ([]*bgpconfig.Neighbor, error) {
+	nodes, err := s.client.Nodes().List(calicoapi.NodeMetadata{})
 	if err != nil {
 		return nil, err
 	}
-	ns := make([]*bgpconfig.Neighbor, 0, len(list.Items))
-	for _, node := range list.Items {
-		addr := node.Metadata.PeerIP.String()
-		ns = append(ns, &bgpconfig.Neighbor{
-			Config: bgpconfig.NeighborConfig{
-				NeighborAddress: addr,
-				PeerAs:          uint32(node.Spec.ASNumber),
-				Description:     fmt.Sprintf("%s_%s", strings.Title(neighborType), underscore(addr)),
-			},
-		})
+	return s.meshNeighbors(nodes.Items, mesh)
+}
+
+// meshNeighbors returns the mesh neighbors of 'nodes'. Their AS numbers
+// are resolved like the watcher does, and a node without one is skipped.
+func (s *Server) meshNeighbors(nodes []calicoapi.Node, mesh *meshConfig) ([]*bgpconfig.Neighbor, error) {
+	ns := make([]*bgpconfig.Neighbor, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Metadata.Name == os.Getenv(NODENAME) || !meshHostAllowed(node.Metadata.Name) {
+			continue
+		}
+		spec := node.Spec.BGP
+		if spec == nil {
+			continue
+		}
+		peerASN, ok, err := s.resolveASN(node.Metadata.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Errorf("no AS number is set for %s. skip its mesh neighbors", node.Metadata.Name)
+			continue
+		}
+		if v4 := spec.IPv4Address; v4 != nil && mesh.enabled(true) {
+			ns = append(ns, s.newMeshNeighbor(v4.IP.String(), uint32(peerASN)))
+		}
+		if v6 := spec.IPv6Address; v6 != nil && mesh.enabled(false) {
+			ns = append(ns, s.newMeshNeighbor(v6.IP.String(), uint32(peerASN)))
+		}
 	}
 	return ns, nil
 }
 
-// getGlobalNeighborConfigs returns the list of global BGP neighbor configuration struct
-func (s *Server) getGlobalNeighborConfigs() ([]*bgpconfig.Neighbor, error) {
-	return s.getNonMeshNeighborConfigs("global")
+// updateMeshFamilies adds or deletes the mesh neighbors 'ns' of the address
+// families whose mesh state changed from 'prev' to 'cur'. A failure doesn't
+// prevent the other neighbors from being updated.
+func (s *Server) updateMeshFamilies(ns []*bgpconfig.Neighbor, prev, cur *meshConfig) error {
+	var errs []string
+	for _, n := range ns {
+		var err error
+		v4 := net.ParseIP(n.Config.NeighborAddress).To4() != nil
+		switch {
+		case cur.enabled(v4) && !prev.enabled(v4):
+			err = s.addNeighbor(n)
+		case !cur.enabled(v4) && prev.enabled(v4):
+			err = s.deleteNeighbor(n)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", n.Config.NeighborAddress, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to update %d mesh neighbor(s): %s", len(errs), strings.Join(errs, ", "))
+	}
+	return nil
 }
 
-// getNodeNeighborConfigs returns the list of node specific BGP neighbor configuration struct
-func (s *Server) getNodeSpecificNeighborConfigs() ([]*bgpconfig.Neighbor, error) {
-	return s.getNonMeshNeighborConfigs("node")
+// updateMeshASN re-adds the mesh neighbors of 'host' after a change of its
+// AS number. The AS number is resolved again from all the sources, so a
+// set value which is invalid falls through to the next source, and a
+// deleted one to the global AS number.
+func (s *Server) updateMeshASN(host string, mesh *meshConfig) error {
+	// a host with a broken AS number doesn't block the others
+	asn, ok, err := s.resolveASN(host)
+	if err != nil {
+		log.Errorf("failed to get the AS number of %s. skip its mesh neighbors: %s", host, err)
+		return nil
+	}
+	if !ok {
+		log.Errorf("no AS number is set for %s. skip its mesh neighbors", host)
+		return nil
+	}
+	// update both families even if one of them fails
+	var errs []string
+	for _, version := range []string{"v4", "v6"} {
+		if !mesh.enabled(version == "v4") {
+			continue
+		}
+		res, err := s.etcd.Get(context.Background(), fmt.Sprintf("%s/host/%s/ip_addr_%s", CALICO_BGP, host, version), nil)
+		if errorButKeyNotFound(err) != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if res == nil || res.Node.Value == "" {
+			continue
+		}
+		ip := normalizeAddress(res.Node.Value)
+		if err = s.deleteNeighbor(&bgpconfig.Neighbor{Config: bgpconfig.NeighborConfig{NeighborAddress: ip}}); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if err = s.addNeighbor(s.newMeshNeighbor(ip, uint32(asn))); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to update the AS number of %s: %s", host, strings.Join(errs, ", "))
+	}
+	return nil
 }
 
-// getNeighborConfigs returns the complete list of BGP neighbor configuration
-// which the node should peer.
-func (s *Server) getNeighborConfigs() ([]*bgpconfig.Neighbor, error) {
-	var neighbors []*bgpconfig.Neighbor
-	// --- Node-to-node mesh ---
-	if mesh, err := s.isMeshMode(); err == nil && mesh {
-		ns, err := s.getMeshNeighborConfigs()
-		if err != nil {
-			return nil, err
+// meshHostAllowed returns true if 'host' may be a mesh neighbor according to
+// MESH_ALLOW and MESH_DENY
+func meshHostAllowed(host string) bool {
+	listed := func(name string) bool {
+		for _, h := range strings.Split(os.Getenv(name), ",") {
+			if strings.TrimSpace(h) == host {
+				return true
+			}
 		}
-		neighbors = append(neighbors, ns...)
-	} else if err != nil {
-		return nil, err
-	}
-	// --- Global peers ---
-	if ns, err := s.getGlobalNeighborConfigs(); err != nil {
-		return nil, err
-	} else {
-		neighbors = append(neighbors, ns...)
+		return false
 	}
-	// --- Node-specific peers ---
-	if ns, err := s.getNodeSpecificNeighborConfigs(); err != nil {
-		return nil, err
-	} else {
-		neighbors = append(neighbors, ns...)
+	if listed(MESH_DENY) {
+		return false
 	}
-	return neighbors, nil
+	return os.Getenv(MESH_ALLOW) == "" || listed(MESH_ALLOW)
 }
 
-func etcdKeyToPrefix(key string) string {
-	path := strings.Split(key, "/")
-	return strings.Replace(path[len(path)-1], "-", "/", 1)
+// peerConfig is the value of a BGP peer stored in etcd.
+// Fields other than ip and as_num are optional and not managed by calicoctl.
+type peerConfig struct {
+	IP  string `json:"ip"`
+	ASN string `json:"as_num"`
+	// MultihopTTL enables eBGP multihop with the given TTL
+	MultihopTTL uint8 `json:"multihop_ttl,omitempty"`
+	// AddPathsReceive and AddPathsSendMax negotiate ADD-PATH (RFC 7911)
+	AddPathsReceive bool  `json:"add_paths_receive,omitempty"`
+	AddPathsSendMax uint8 `json:"add_paths_send_max,omitempty"`
+	// Passive makes the daemon wait for the peer to connect
+	Passive bool `json:"passive,omitempty"`
+	// Password enables TCP MD5 authentication of the session
+	Password string `json:"password,omitempty"`
+	// Families overrides the address families enabled on the session
+	Families []string `json:"families,omitempty"`
+	// SourceAddress is the local address of the session
+	SourceAddress string `json:"source_address,omitempty"`
+	// ASPathPrepend is how many times the local AS is prepended to the
+	// routes advertised to the peer
+	ASPathPrepend uint8 `json:"as_path_prepend,omitempty"`
+	// HoldTime and KeepaliveInterval are the session timers in seconds
+	HoldTime          float64 `json:"hold_time,omitempty"`
+	KeepaliveInterval float64 `json:"keepalive_interval,omitempty"`
+	// MRAI is the minimum route advertisement interval in seconds
+	MRAI float64 `json:"mrai,omitempty"`
+	// Protected keeps the session of a global peer when its key is
+	// deleted. The peer must be set with "protected": false before the
+	// deletion to confirm it.
+	Protected bool `json:"protected,omitempty"`
 }
 
-func (s *Server) makePath(prefix string, isWithdrawal bool) (*bgptable.Path, error) {
-	_, ipNet, err := net.ParseCIDR(prefix)
+// onlyProtectionChanged returns true if the peers 'prev' and 'cur' differ
+// in Protected alone, which doesn't need the neighbor to be re-applied
+func onlyProtectionChanged(prev, cur string) bool {
+	p, err := parsePeerConfig([]byte(prev))
 	if err != nil {
-		return nil, err
+		return false
 	}
+	c, err := parsePeerConfig([]byte(cur))
+	if err != nil || p.Protected == c.Protected {
+		return false
+	}
+	p.Protected, c.Protected = false, false
+	pb, _ := json.Marshal(p)
+	cb, _ := json.Marshal(c)
+	return string(pb) == string(cb)
+}
 
-	p := ipNet.IP
-	masklen, _ := ipNet.Mask.Size()
-	v4 := true
-	if p.To4() == nil {
-		v4 = false
+// privateNetworks are the address ranges of private peers
+var privateNetworks = func() []*net.IPNet {
+	var ns []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "fc00::/7", "fe80::/10", "::1/128"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		ns = append(ns, n)
 	}
+	return ns
+}()
 
-	var nlri bgp.AddrPrefixInterface
-	attrs := []bgp.PathAttributeInterface{
-		bgp.NewPathAttributeOrigin(0),
+// isPrivateAddress returns true if 'ip' is in one of privateNetworks
+func isPrivateAddress(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
 	}
+	return false
+}
 
-	if v4 {
-		nlri = bgp.NewIPAddrPrefix(uint8(masklen), p.String())
-		attrs = append(attrs, bgp.NewPathAttributeNextHop(s.ipv4.String()))
-	} else {
-		nlri = bgp.NewIPv6AddrPrefix(uint8(masklen), p.String())
-		attrs = append(attrs, bgp.NewPathAttributeMpReachNLRI(s.ipv6.String(), []bgp.AddrPrefixInterface{nlri}))
+// parsePeerConfig parses the peer 'data' over the profile of its address.
+// A peer given by hostname has no profile.
+func parsePeerConfig(data []byte) (*peerConfig, error) {
+	probe := &peerConfig{}
+	if err := json.Unmarshal(data, probe); err != nil {
+		return nil, err
+	}
+	m := &peerConfig{}
+	if ip := net.ParseIP(probe.IP); ip != nil {
+		name := PUBLIC_PEER_PROFILE
+		if isPrivateAddress(ip) {
+			name = PRIVATE_PEER_PROFILE
+		}
+		if profile := os.Getenv(name); profile != "" {
+			if err := json.Unmarshal([]byte(profile), m); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", name, err)
+			}
+		}
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
 	}
+	return m, nil
+}
 
-	return bgptable.NewPath(nil, nlri, isWithdrawal, attrs, time.Now(), false), nil
+// newNeighbor returns a BGP neighbor configuration struct with the address
+// families to enable on the session
+func (s *Server) newNeighbor(addr string, asn uint32, description string) *bgpconfig.Neighbor {
+	addr = normalizeAddress(addr)
+	families := s.families
+	if len(families) == 0 {
+		families = []bgpconfig.AfiSafiType{bgpconfig.AFI_SAFI_TYPE_IPV4_UNICAST}
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			families = []bgpconfig.AfiSafiType{bgpconfig.AFI_SAFI_TYPE_IPV6_UNICAST}
+		}
+	}
+	n := &bgpconfig.Neighbor{
+		Config: bgpconfig.NeighborConfig{
+			NeighborAddress: addr,
+			PeerAs:          asn,
+			Description:     description,
+		},
+		AfiSafis: s.afiSafis(families),
+	}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil && s.ipv6ASN != 0 {
+		n.Config.LocalAs = uint32(s.ipv6ASN)
+	}
+	if s.staleTime > 0 {
+		n.GracefulRestart.Config.Enabled = true
+		n.GracefulRestart.Config.RestartTime = gracefulRestartTime
+		n.GracefulRestart.Config.LongLivedEnabled = true
+	}
+	if s.mrai > 0 {
+		n.Timers.Config.MinimumAdvertisementInterval = s.mrai
+	}
+	return n
 }
 
-// getAssignedPrefixes retrives prefixes assigned to the node and returns them as a
-// list of BGP path.
-// using etcd directly since libcalico-go doesn't seem to have a method to return
-// assigned prefixes yet.
-func (s *Server) getAssignedPrefixes(api etcd.KeysAPI) ([]*bgptable.Path, uint64, error) {
-	var ps []*bgptable.Path
-	var index uint64
-	f := func(version string) error {
-		res, err := api.Get(context.Background(), fmt.Sprintf("%s/%s/%s/block", CALICO_AGGR, os.Getenv(NODENAME), version), &etcd.GetOptions{Recursive: true})
+// newMeshNeighbor returns the configuration of the mesh neighbor at 'addr'
+// whose node has the AS number 'asn'. IPv6 mesh neighbors use IPV6_AS
+// when it is set.
+func (s *Server) newMeshNeighbor(addr string, asn uint32) *bgpconfig.Neighbor {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil && s.ipv6ASN != 0 {
+		asn = uint32(s.ipv6ASN)
+	}
+	return s.newNeighbor(addr, asn, fmt.Sprintf("Mesh_%s", underscore(normalizeAddress(addr))))
+}
+
+// afiSafis returns the address family configurations of 'families',
+// with graceful restart enabled on them when s.staleTime is set
+func (s *Server) afiSafis(families []bgpconfig.AfiSafiType) []bgpconfig.AfiSafi {
+	afiSafis := make([]bgpconfig.AfiSafi, 0, len(families))
+	for _, f := range families {
+		a := bgpconfig.AfiSafi{
+			Config: bgpconfig.AfiSafiConfig{
+				AfiSafiName: f,
+				Enabled:     true,
+			},
+		}
+		if s.staleTime > 0 {
+			a.MpGracefulRestart.Config.Enabled = true
+			a.LongLivedGracefulRestart.Config.Enabled = true
+			a.LongLivedGracefulRestart.Config.RestartTime = s.staleTime
+		}
+		afiSafis = append(afiSafis, a)
+	}
+	return afiSafis
+}
+
+// getNeighborConfigFromPeer returns a BGP neighbor configuration struct from *etcd.Node
+// IPv4 and IPv6 peers are stored under peer_v4 and peer_v6 respectively.
+// The peer address must belong to the family of the key so that adding and
+// deleting a peer always operates on the neighbor of that family.
+// localAS is used to tell eBGP peers from iBGP peers.
+func (s *Server) getNeighborConfigFromPeer(node *etcd.Node, neighborType string, localAS uint32) (*bgpconfig.Neighbor, error) {
+	m, err := parsePeerConfig([]byte(node.Value))
+	if err != nil {
+		return nil, err
+	}
+	v4 := strings.Contains(node.Key, "/peer_v4/")
+	ip := net.ParseIP(m.IP)
+	if ip == nil {
+		if os.Getenv(RESOLVE_INTERVAL) == "" {
+			return nil, fmt.Errorf("invalid peer address %q in %s", m.IP, node.Key)
+		}
+		var err error
+		if ip, err = s.resolvePeer(m.IP, v4); err != nil {
+			return nil, err
+		}
+		return s.hostnameNeighbor(m, ip, neighborType, localAS)
+	}
+	if (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("peer address %s doesn't match the address family of %s", m.IP, node.Key)
+	}
+	return s.neighborFromPeerConfig(m, neighborType, localAS)
+}
+
+// neighborFromPeerConfig returns the BGP neighbor configuration struct of
+// the peer 'm'
+func (s *Server) neighborFromPeerConfig(m *peerConfig, neighborType string, localAS uint32) (*bgpconfig.Neighbor, error) {
+	if net.ParseIP(m.IP) == nil {
+		if os.Getenv(RESOLVE_INTERVAL) == "" {
+			return nil, fmt.Errorf("invalid peer address %q", m.IP)
+		}
+		ip, err := s.resolvePeer(m.IP, true)
 		if err != nil {
-			return err
+			if ip, err = s.resolvePeer(m.IP, false); err != nil {
+				return nil, err
+			}
 		}
-		if index == 0 {
-		        index = res.Index
+		return s.hostnameNeighbor(m, ip, neighborType, localAS)
+	}
+	m.IP = normalizeAddress(m.IP)
+	asn, err := numorstring.ASNumberFromString(m.ASN)
+	if err != nil {
+		return nil, err
+	}
+	n := s.newNeighbor(m.IP, uint32(asn), fmt.Sprintf("%s_%s", strings.Title(neighborType), underscore(m.IP)))
+	if n.Config.LocalAs != 0 {
+		localAS = n.Config.LocalAs
+	}
+	if m.MultihopTTL > 0 {
+		if n.Config.PeerAs == localAS {
+			log.Printf("ignore multihop_ttl of iBGP peer %s", m.IP)
+		} else {
+			n.EbgpMultihop.Config.Enabled = true
+			n.EbgpMultihop.Config.MultihopTtl = m.MultihopTTL
 		}
-		for _, v := range res.Node.Nodes {
-			path, err := s.makePath(etcdKeyToPrefix(v.Key), false)
-			if err != nil {
-				return err
+	}
+	n.AddPaths.Config.Receive = m.AddPathsReceive
+	n.AddPaths.Config.SendMax = m.AddPathsSendMax
+	n.Transport.Config.PassiveMode = m.Passive
+	n.Config.AuthPassword = m.Password
+	if m.HoldTime > 0 {
+		n.Timers.Config.HoldTime = m.HoldTime
+	}
+	if m.KeepaliveInterval > 0 {
+		n.Timers.Config.KeepaliveInterval = m.KeepaliveInterval
+	}
+	if m.MRAI > 0 {
+		n.Timers.Config.MinimumAdvertisementInterval = m.MRAI
+	}
+	if len(m.Families) > 0 {
+		families := make([]bgpconfig.AfiSafiType, 0, len(m.Families))
+		for _, name := range m.Families {
+			f := bgpconfig.AfiSafiType(name)
+			if err := f.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid family of peer %s: %s", m.IP, err)
 			}
-			ps = append(ps, path)
+			families = append(families, f)
 		}
-		return nil
+		n.AfiSafis = s.afiSafis(families)
 	}
-	if s.ipv4 != nil {
-		if err := f("ipv4"); err != nil {
-			return nil, 0, err
+	if m.ASPathPrepend > 0 {
+		n.ApplyPolicy.Config.ExportPolicyList = []string{prependPolicyName(m.ASPathPrepend)}
+	}
+	if m.SourceAddress != "" {
+		if net.ParseIP(m.SourceAddress) == nil {
+			return nil, fmt.Errorf("invalid source address %q of peer %s", m.SourceAddress, m.IP)
 		}
+		n.Transport.Config.LocalAddress = normalizeAddress(m.SourceAddress)
 	}
-	if s.ipv6 != nil {
-		if err := f("ipv6"); err != nil {
-			return nil, 0, err
+	return n, nil
+}
+
+// resolveHostname returns the first address of 'host' in the address family
+func (s *Server) resolveHostname(host string, v4 bool) (net.IP, error) {
+	lookupIP := net.LookupIP
+	if s.lookupIP != nil {
+		lookupIP = s.lookupIP
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			return ip, nil
 		}
 	}
-	return ps, index, nil
+	if v4 {
+		return nil, fmt.Errorf("%s has no IPv4 address", host)
+	}
+	return nil, fmt.Errorf("%s has no IPv6 address", host)
 }
 
-// watchPrefix watches etcd /calico/ipam/v2/host/$NODENAME and add/delete
-// aggregated routes which are assigned to the node.
-// This function also updates policy appropriately.
-func (s *Server) watchPrefix() error {
+// resolvePeer returns the address of the peer given by the hostname 'host'.
+// The address of a known peer is the one it was added with, so that the
+// neighbor is found when the peer is deleted; resolveHostnamePeers follows
+// the changes.
+func (s *Server) resolvePeer(host string, v4 bool) (net.IP, error) {
+	s.hostnameMu.Lock()
+	n, ok := s.hostnamePeers[host]
+	s.hostnameMu.Unlock()
+	if ok {
+		if ip := net.ParseIP(n.Config.NeighborAddress); (ip.To4() != nil) == v4 {
+			return ip, nil
+		}
+	}
+	return s.resolveHostname(host, v4)
+}
 
-	paths, index, err := s.getAssignedPrefixes(s.etcd)
+// hostnameNeighbor returns the neighbor of the peer 'm' given by hostname,
+// with the address 'ip' it resolved to, and remembers it so that
+// resolveHostnamePeers can follow address changes
+func (s *Server) hostnameNeighbor(m *peerConfig, ip net.IP, neighborType string, localAS uint32) (*bgpconfig.Neighbor, error) {
+	host := m.IP
+	resolved := *m
+	resolved.IP = ip.String()
+	n, err := s.neighborFromPeerConfig(&resolved, neighborType, localAS)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	n.Config.Description = fmt.Sprintf("%s_%s", strings.Title(neighborType), underscore(host))
+	s.hostnameMu.Lock()
+	defer s.hostnameMu.Unlock()
+	if s.hostnamePeers == nil {
+		s.hostnamePeers = make(map[string]*bgpconfig.Neighbor)
+	}
+	s.hostnamePeers[host] = n
+	return n, nil
+}
 
-	if err = s.updatePrefixSet(paths); err != nil {
-		return err
+// resolveHostnamePeers resolves the hostnames of the peers every 'interval'
+// and replaces a neighbor whose address has changed. A hostname which
+// fails to resolve is retried next time.
+func (s *Server) resolveHostnamePeers(interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// a limiter per hostname, as each fails on its own
+	errs := make(map[string]*errorLimiter)
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.t.Dying():
+			return nil
+		}
+		if err := s.reresolvePeers(errs); err != nil {
+			return err
+		}
 	}
+}
 
-	if _, err := s.bgpServer.AddPath("", paths); err != nil {
-		return err
+// reresolvePeers resolves the hostnames of the peers once, and replaces a
+// neighbor whose address has changed. 'errs' limits the logs of the
+// failures to resolve each hostname.
+func (s *Server) reresolvePeers(errs map[string]*errorLimiter) error {
+	s.hostnameMu.Lock()
+	peers := make(map[string]*bgpconfig.Neighbor, len(s.hostnamePeers))
+	for host, n := range s.hostnamePeers {
+		peers[host] = n
 	}
+	s.hostnameMu.Unlock()
 
-	watcher := s.etcd.Watcher(fmt.Sprintf("%s/%s", CALICO_AGGR, os.Getenv(NODENAME)), &etcd.WatcherOptions{Recursive: true, AfterIndex: index})
-	for {
-		var err error
-		res, err := watcher.Next(context.Background())
+	for host, n := range peers {
+		addr := n.Config.NeighborAddress
+		// forget the peers which have been deleted
+		if len(s.getNeighbors(addr)) == 0 {
+			s.hostnameMu.Lock()
+			if s.hostnamePeers[host] == n {
+				delete(s.hostnamePeers, host)
+			}
+			s.hostnameMu.Unlock()
+			delete(errs, host)
+			continue
+		}
+		if errs[host] == nil {
+			l, err := newErrorLimiter()
+			if err != nil {
+				return err
+			}
+			errs[host] = l
+		}
+		ip, err := s.resolveHostname(host, net.ParseIP(addr).To4() != nil)
 		if err != nil {
-			return err
+			errs[host].log(log.Warnf, fmt.Sprintf("failed to resolve peer %s: %s", host, err))
+			continue
 		}
-		var path *bgptable.Path
-		key := etcdKeyToPrefix(res.Node.Key)
-		if res.Action == "delete" {
-			path, err = s.makePath(key, true)
-		} else {
-			path, err = s.makePath(key, false)
+		errs[host].reset(fmt.Sprintf("resolved peer %s again", host))
+		if ip.String() == addr {
+			continue
+		}
+		log.Printf("peer %s moved from %s to %s", host, addr, ip)
+		c := *n
+		c.Config.NeighborAddress = ip.String()
+		if err = s.replaceNeighbor(n, &c); err != nil {
+			log.Errorf("failed to re-add peer %s: %s", host, err)
+			continue
+		}
+		s.hostnameMu.Lock()
+		s.hostnamePeers[host] = &c
+		s.hostnameMu.Unlock()
+	}
+	return nil
+}
+
+// getUnnumberedNeighborConfigs returns the list of BGP neighbor
+// configuration struct of the "interface:AS" entries. An interface without
+// a router found on it is logged and skipped.
+func (s *Server) getUnnumberedNeighborConfigs(entries []string) ([]*bgpconfig.Neighbor, error) {
+	var ns []*bgpconfig.Neighbor
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		elems := strings.SplitN(entry, ":", 2)
+		if len(elems) != 2 {
+			return nil, fmt.Errorf("invalid %s: %s", UNNUMBERED_INTERFACES, entry)
 		}
+		iface := elems[0]
+		asn, err := numorstring.ASNumberFromString(elems[1])
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("invalid %s: %s", UNNUMBERED_INTERFACES, err)
 		}
-		paths := []*bgptable.Path{path}
-		if err = s.updatePrefixSet(paths); err != nil {
-			return err
+		linkLocalNeighbor := bgpconfig.GetIPv6LinkLocalNeighborAddress
+		if s.linkLocalNeighbor != nil {
+			linkLocalNeighbor = s.linkLocalNeighbor
 		}
-		if _, err := s.bgpServer.AddPath("", paths); err != nil {
-			return err
+		addr, err := linkLocalNeighbor(iface)
+		if err != nil {
+			log.Warnf("skip unnumbered neighbor on %s: %s", iface, err)
+			continue
 		}
-		log.Printf("add path: %s", path)
+		n := s.newNeighbor(addr, uint32(asn), fmt.Sprintf("Unnumbered_%s", iface))
+		n.Config.NeighborInterface = iface
+		families := s.families
+		if len(families) == 0 {
+			families = []bgpconfig.AfiSafiType{bgpconfig.AFI_SAFI_TYPE_IPV6_UNICAST}
+		}
+		n.AfiSafis = s.afiSafis(families)
+		ns = append(ns, n)
 	}
+	return ns, nil
 }
 
-// watchBGPConfig watches etcd path /calico/bgp/v1 and handle various changes
-// in etcd. Though this method tries to minimize effects to the existing BGP peers,
-// when /calico/bgp/v1/host/$NODENAME or /calico/global/as_num is changed,
-// give up handling the change and return error (this leads calico-bgp-daemon to be restarted)
-func (s *Server) watchBGPConfig() error {
-	var index uint64
-	res, err := s.etcd.Get(context.Background(), CALICO_BGP, nil)
+// getStaticNeighborConfigs returns the list of BGP neighbor configuration
+// struct read from the file at 'path'. Malformed entries are skipped.
+func (s *Server) getStaticNeighborConfigs(path string) ([]*bgpconfig.Neighbor, error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	index = res.Index
-
-	neighborConfigs, err := s.getNeighborConfigs()
+	var peers []json.RawMessage
+	if err = json.Unmarshal(b, &peers); err != nil {
+		return nil, fmt.Errorf("invalid static neighbors file %s: %s", path, err)
+	}
+	localAS, err := s.getNodeASN()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	for _, n := range neighborConfigs {
-		if err = s.bgpServer.AddNeighbor(n); err != nil {
-			return err
+	ns := make([]*bgpconfig.Neighbor, 0, len(peers))
+	for i, data := range peers {
+		m, err := parsePeerConfig(data)
+		if err != nil {
+			log.Errorf("skip static neighbor #%d in %s: %s", i, path, err)
+			continue
+		}
+		n, err := s.neighborFromPeerConfig(m, "static", uint32(localAS))
+		if err != nil {
+			log.Errorf("skip static neighbor #%d in %s: %s", i, path, err)
+			continue
 		}
+		ns = append(ns, n)
 	}
+	return ns, nil
+}
 
-	watcher := s.etcd.Watcher(CALICO_BGP, &etcd.WatcherOptions{Recursive: true, AfterIndex: index})
+// watchStaticNeighborsFile adds, updates and deletes the static neighbors
+// as the file at 'path' changes. The neighbors read at startup are
+// already added.
+func (s *Server) watchStaticNeighborsFile(path string) error {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	prev, _, err := s.staticNeighbors(path)
+	if err != nil {
+		log.Warnf("failed to read static neighbors: %s", err)
+	}
+	errs, err := newErrorLimiter()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(staticNeighborsCheckInterval)
+	defer ticker.Stop()
 	for {
-		res, err := watcher.Next(context.Background())
+		select {
+		case <-ticker.C:
+		case <-s.t.Dying():
+			return nil
+		}
+		if s.inMaintenance() {
+			continue
+		}
+		fi, err := os.Stat(path)
 		if err != nil {
-			return err
+			errs.log(log.Warnf, fmt.Sprintf("failed to stat static neighbors file: %s", err))
+			continue
 		}
-		prev := ""
-		if res.PrevNode != nil {
-			prev = res.PrevNode.Value
+		errs.reset(fmt.Sprintf("static neighbors file %s is back", path))
+		if fi.ModTime().Equal(modTime) {
+			continue
 		}
-		log.Printf("watch: action: %s, key: %s node: %s, prev-node: %s", res.Action, res.Node.Key, res.Node.Value, prev)
-		if res.Action == "set" && res.Node.Value == prev {
-			log.Printf("same value. ignore")
+		modTime = fi.ModTime()
+		cur, configured, err := s.staticNeighbors(path)
+		if err != nil {
+			log.Warnf("failed to read static neighbors: %s", err)
 			continue
 		}
+		log.Printf("static neighbors file %s changed", path)
+		added, deleted := diffStaticNeighbors(prev, cur, configured)
+		for _, n := range added {
+			if err := s.addNeighbor(n); err != nil {
+				log.Errorf("failed to add static neighbor %s: %s", n.Config.NeighborAddress, err)
+				delete(cur, n.Config.NeighborAddress)
+			}
+		}
+		for _, n := range deleted {
+			if err := s.deleteNeighbor(n); err != nil {
+				log.Errorf("failed to delete static neighbor %s: %s", n.Config.NeighborAddress, err)
+			}
+		}
+		prev = cur
+	}
+}
+
+// staticNeighbors returns the static neighbors in the file at 'path' which
+// no other neighbor of the same address takes precedence over, by address,
+// and the addresses of all the configured neighbors
+func (s *Server) staticNeighbors(path string) (map[string]*bgpconfig.Neighbor, map[string]bool, error) {
+	static, err := s.getStaticNeighborConfigs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	all, err := s.getNeighborConfigs()
+	if err != nil {
+		return nil, nil, err
+	}
+	winners := make(map[string]*bgpconfig.Neighbor, len(all))
+	configured := make(map[string]bool, len(all))
+	for _, n := range all {
+		winners[n.Config.NeighborAddress] = n
+		configured[n.Config.NeighborAddress] = true
+	}
+	ns := make(map[string]*bgpconfig.Neighbor, len(static))
+	for _, n := range static {
+		addr := n.Config.NeighborAddress
+		if w := winners[addr]; w != nil && w.Config.Description == n.Config.Description {
+			ns[addr] = w
+		}
+	}
+	return ns, configured, nil
+}
 
-		handleNonMeshNeighbor := func(neighborType string) error {
-			switch res.Action {
-			case "delete":
-				n, err := getNeighborConfigFromPeer(res.PrevNode, neighborType)
-				if err != nil {
-					return err
-				}
-				return s.bgpServer.DeleteNeighbor(n)
-			case "set", "create", "update", "compareAndSwap":
-				n, err := getNeighborConfigFromPeer(res.Node, neighborType)
-				if err != nil {
-					return err
-				}
-				return s.bgpServer.AddNeighbor(n)
+// diffStaticNeighbors returns the static neighbors in 'cur' which are new
+// or changed since 'prev', and those in 'prev' which are gone. A neighbor
+// whose address is still 'configured' by another source isn't deleted, as
+// that neighbor has replaced it.
+func diffStaticNeighbors(prev, cur map[string]*bgpconfig.Neighbor, configured map[string]bool) (added, deleted []*bgpconfig.Neighbor) {
+	for addr, n := range cur {
+		if p, ok := prev[addr]; !ok || !reflect.DeepEqual(p, n) {
+			added = append(added, n)
+		}
+	}
+	for addr, n := range prev {
+		if _, ok := cur[addr]; !ok && !configured[addr] {
+			deleted = append(deleted, n)
+		}
+	}
+	return added, deleted
+}
+
+// getNonMeshNeighborConfigs returns the list of non-mesh BGP neighbor configuration struct
+// valid neighborType is either "global" or "node"
+// The peers are read from etcd directly, as the watcher does, since
+// libcalico-go drops the optional fields of peerConfig.
+func (s *Server) getNonMeshNeighborConfigs(neighborType string) ([]*bgpconfig.Neighbor, error) {
+	var dir string
+	switch neighborType {
+	case "global":
+		dir = fmt.Sprintf("%s/global", CALICO_BGP)
+	case "node":
+		dir = fmt.Sprintf("%s/host/%s", CALICO_BGP, os.Getenv(NODENAME))
+	default:
+		return nil, fmt.Errorf("invalid neighbor type: %s", neighborType)
+	}
+	localAS, err := s.getNodeASN()
+	if err != nil {
+		return nil, err
+	}
+	var ns []*bgpconfig.Neighbor
+	for _, version := range []string{"v4", "v6"} {
+		res, err := s.etcd.Get(context.Background(), fmt.Sprintf("%s/peer_%s", dir, version), &etcd.GetOptions{Recursive: true})
+		if errorButKeyNotFound(err) != nil {
+			return nil, err
+		}
+		if res == nil {
+			continue
+		}
+		for _, node := range res.Node.Nodes {
+			n, err := s.getNeighborConfigFromPeer(node, neighborType, uint32(localAS))
+			if err != nil {
+				return nil, err
 			}
-			log.Printf("unhandled action: %s", res.Action)
-			return nil
+			ns = append(ns, n)
 		}
+	}
+	return ns, nil
+}
 
-		key := res.Node.Key
-		switch {
-		case strings.HasPrefix(key, fmt.Sprintf("%s/global/peer_", CALICO_BGP)):
-			err = handleNonMeshNeighbor("global")
-		case strings.HasPrefix(key, fmt.Sprintf("%s/host/%s/peer_", CALICO_BGP, os.Getenv(NODENAME))):
+// getGlobalNeighborConfigs returns the list of global BGP neighbor configuration struct
+func (s *Server) getGlobalNeighborConfigs() ([]*bgpconfig.Neighbor, error) {
+	return s.getNonMeshNeighborConfigs("global")
+}
+
+// getNodeNeighborConfigs returns the list of node specific BGP neighbor configuration struct
+func (s *Server) getNodeSpecificNeighborConfigs() ([]*bgpconfig.Neighbor, error) {
+	return s.getNonMeshNeighborConfigs("node")
+}
+
+// getNeighborConfigs returns the complete list of BGP neighbor configuration
+// which the node should peer.
+func (s *Server) getNeighborConfigs() ([]*bgpconfig.Neighbor, error) {
+	var neighbors []*bgpconfig.Neighbor
+	// --- Static neighbors ---
+	if path := os.Getenv(STATIC_NEIGHBORS_FILE); path != "" {
+		ns, err := s.getStaticNeighborConfigs(path)
+		if err != nil {
+			return nil, err
+		}
+		neighbors = append(neighbors, ns...)
+	}
+	// --- Unnumbered neighbors ---
+	if v := os.Getenv(UNNUMBERED_INTERFACES); v != "" {
+		ns, err := s.getUnnumberedNeighborConfigs(strings.Split(v, ","))
+		if err != nil {
+			return nil, err
+		}
+		neighbors = append(neighbors, ns...)
+	}
+	// --- Node-to-node mesh ---
+	if mesh, err := s.getMeshConfig(); err != nil {
+		return nil, err
+	} else if mesh.enabled(true) || mesh.enabled(false) {
+		ns, err := s.getMeshNeighborConfigs(mesh)
+		if err != nil {
+			return nil, err
+		}
+		neighbors = append(neighbors, ns...)
+	}
+	// --- Global peers ---
+	if ns, err := s.getGlobalNeighborConfigs(); err != nil {
+		return nil, err
+	} else {
+		neighbors = append(neighbors, ns...)
+	}
+	// --- Node-specific peers ---
+	if ns, err := s.getNodeSpecificNeighborConfigs(); err != nil {
+		return nil, err
+	} else {
+		neighbors = append(neighbors, ns...)
+	}
+	if err := s.checkNeighbors(neighbors); err != nil {
+		return nil, err
+	}
+	return dedupNeighbors(neighbors), nil
+}
+
+// checkNeighbors logs what validateNeighbors finds in the neighbors 'ns'.
+// It returns an error if it finds errors and STRICT_VALIDATION is set.
+func (s *Server) checkNeighbors(ns []*bgpconfig.Neighbor) error {
+	warnings, errs := s.validateNeighbors(ns)
+	for _, w := range warnings {
+		log.Warn(w)
+	}
+	for _, e := range errs {
+		log.Error(e)
+	}
+	if len(errs) > 0 {
+		if strict, _ := strconv.ParseBool(os.Getenv(STRICT_VALIDATION)); strict {
+			return fmt.Errorf("invalid neighbor configuration: %s", strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// validateNeighbors checks that the neighbors are consistent before they
+// are applied. It returns warnings about the neighbors which can be
+// applied anyway, and errors about the ones which can't. Duplicate
+// addresses are reported by dedupNeighbors, which resolves them.
+func (s *Server) validateNeighbors(ns []*bgpconfig.Neighbor) (warnings []string, errs []string) {
+	for _, n := range ns {
+		c := n.Config
+		// link-local addresses of unnumbered neighbors have a zone
+		addr := c.NeighborAddress
+		if i := strings.Index(addr, "%"); i >= 0 {
+			addr = addr[:i]
+		}
+		if net.ParseIP(addr) == nil {
+			errs = append(errs, fmt.Sprintf("%s has an invalid address %q", c.Description, c.NeighborAddress))
+			continue
+		}
+		if c.PeerAs == 0 {
+			errs = append(errs, fmt.Sprintf("%s has no AS number", c.Description))
+		}
+		if len(n.AfiSafis) == 0 {
+			errs = append(errs, fmt.Sprintf("%s has no address family", c.Description))
+		}
+		if ip := net.ParseIP(addr); ip.Equal(s.ipv4) || ip.Equal(s.ipv6) {
+			warnings = append(warnings, fmt.Sprintf("%s is this node's own address %s", c.Description, c.NeighborAddress))
+		}
+	}
+	return warnings, errs
+}
+
+// dedupNeighbors drops the neighbors which have the same address as a
+// neighbor later in the list. As getNeighborConfigs lists static neighbors,
+// mesh neighbors, global peers and node-specific peers in this order,
+// node-specific peers take precedence over global peers, which take
+// precedence over the mesh and then the static neighbors.
+func dedupNeighbors(ns []*bgpconfig.Neighbor) []*bgpconfig.Neighbor {
+	winners := make(map[string]*bgpconfig.Neighbor, len(ns))
+	for _, n := range ns {
+		winners[n.Config.NeighborAddress] = n
+	}
+	ret := make([]*bgpconfig.Neighbor, 0, len(winners))
+	for _, n := range ns {
+		if w := winners[n.Config.NeighborAddress]; w != n {
+			log.Warnf("%s and %s have the same address %s. use %s", n.Config.Description, w.Config.Description, n.Config.NeighborAddress, w.Config.Description)
+			continue
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+func etcdKeyToPrefix(key string) string {
+	path := strings.Split(key, "/")
+	return strings.Replace(path[len(path)-1], "-", "/", 1)
+}
+
+// parseOrigin returns the ORIGIN attribute value named 'name'.
+// An empty name is IGP.
+func parseOrigin(name string) (uint8, error) {
+	switch strings.ToLower(name) {
+	case "", "igp":
+		return bgp.BGP_ORIGIN_ATTR_TYPE_IGP, nil
+	case "egp":
+		return bgp.BGP_ORIGIN_ATTR_TYPE_EGP, nil
+	case "incomplete":
+		return bgp.BGP_ORIGIN_ATTR_TYPE_INCOMPLETE, nil
+	}
+	return 0, fmt.Errorf("unknown origin %q", name)
+}
+
+// getStaleTime returns the long-lived graceful restart stale time in
+// seconds set in the environment, or zero when it is not set
+func getStaleTime() (uint32, error) {
+	staleTime, err := getDurationFromEnv(GRACEFUL_RESTART_STALE_TIME, 0)
+	if err != nil {
+		return 0, err
+	}
+	if staleTime < 0 || staleTime.Seconds() > maxLongLivedStaleTime {
+		return 0, fmt.Errorf("invalid %s: %s", GRACEFUL_RESTART_STALE_TIME, staleTime)
+	}
+	return uint32(staleTime.Seconds()), nil
+}
+
+// getNodeCommunity returns the large community identifying this node set
+// in the environment, or nil when it is not set
+func getNodeCommunity() (*bgp.LargeCommunity, error) {
+	v := os.Getenv(NODE_COMMUNITY)
+	if v == "" {
+		return nil, nil
+	}
+	elems := strings.Split(v, ":")
+	if len(elems) > 2 {
+		return nil, fmt.Errorf("invalid %s: %s", NODE_COMMUNITY, v)
+	}
+	asn, err := strconv.ParseUint(elems[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", NODE_COMMUNITY, err)
+	}
+	var id uint32
+	if len(elems) == 2 {
+		n, err := strconv.ParseUint(elems[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", NODE_COMMUNITY, err)
+		}
+		id = uint32(n)
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(os.Getenv(NODENAME)))
+		id = h.Sum32()
+	}
+	log.Printf("tag advertised prefixes with %d:%d:0", asn, id)
+	return bgp.NewLargeCommunity(uint32(asn), id, 0), nil
+}
+
+// getMEDConfig returns the MED of the advertised prefixes and the MEDs of
+// individual prefixes set in the environment
+func getMEDConfig() (*uint32, map[string]uint32, error) {
+	var med *uint32
+	if v := os.Getenv(MED); v != "" {
+		m, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %s", MED, err)
+		}
+		med32 := uint32(m)
+		med = &med32
+	}
+	overrides := make(map[string]uint32)
+	for _, entry := range strings.Split(os.Getenv(MED_OVERRIDES), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		elems := strings.SplitN(entry, "=", 2)
+		if len(elems) != 2 {
+			return nil, nil, fmt.Errorf("invalid %s: %s", MED_OVERRIDES, entry)
+		}
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(elems[0]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %s", MED_OVERRIDES, err)
+		}
+		m, err := strconv.ParseUint(strings.TrimSpace(elems[1]), 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %s", MED_OVERRIDES, err)
+		}
+		overrides[ipNet.String()] = uint32(m)
+	}
+	return med, overrides, nil
+}
+
+func (s *Server) makePath(prefix string, isWithdrawal bool) (*bgptable.Path, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	p := ipNet.IP
+	masklen, _ := ipNet.Mask.Size()
+	v4 := true
+	if p.To4() == nil {
+		v4 = false
+	}
+
+	var nlri bgp.AddrPrefixInterface
+	attrs := []bgp.PathAttributeInterface{
+		bgp.NewPathAttributeOrigin(s.origin),
+	}
+	if med, ok := s.medOverrides[ipNet.String()]; ok {
+		attrs = append(attrs, bgp.NewPathAttributeMultiExitDisc(med))
+	} else if s.med != nil {
+		attrs = append(attrs, bgp.NewPathAttributeMultiExitDisc(*s.med))
+	}
+	if s.nodeCommunity != nil {
+		attrs = append(attrs, bgp.NewPathAttributeLargeCommunities([]*bgp.LargeCommunity{s.nodeCommunity}))
+	}
+
+	// the next hop is of the family of the prefix; a node without an
+	// address of that family can't advertise it
+	nexthop := s.nexthop(ipNet)
+	if nexthop == nil {
+		return nil, &noNexthopError{prefix: ipNet}
+	}
+
+	if v4 {
+		nlri = bgp.NewIPAddrPrefix(uint8(masklen), p.String())
+		attrs = append(attrs, bgp.NewPathAttributeNextHop(nexthop.String()))
+	} else {
+		nlri = bgp.NewIPv6AddrPrefix(uint8(masklen), p.String())
+		attrs = append(attrs, bgp.NewPathAttributeMpReachNLRI(nexthop.String(), []bgp.AddrPrefixInterface{nlri}))
+	}
+
+	return bgptable.NewPath(nil, nlri, isWithdrawal, attrs, time.Now(), false), nil
+}
+
+// noNexthopError is returned by makePath for a prefix of an address family
+// this node has no address of
+type noNexthopError struct {
+	prefix *net.IPNet
+}
+
+func (e *noNexthopError) Error() string {
+	family := "IPv4"
+	if e.prefix.IP.To4() == nil {
+		family = "IPv6"
+	}
+	return fmt.Sprintf("no %s next hop to advertise %s with", family, e.prefix)
+}
+
+// nexthop returns the next hop advertised for 'prefix'. When the loopback
+// address is configured, it is the next hop of every prefix of its address
+// family except the loopback host route itself.
+func (s *Server) nexthop(prefix *net.IPNet) net.IP {
+	v4 := prefix.IP.To4() != nil
+	if lo := s.loopback; lo != nil && (lo.To4() != nil) == v4 {
+		ones, bits := prefix.Mask.Size()
+		if !(ones == bits && prefix.IP.Equal(lo)) {
+			return lo
+		}
+	}
+	if v4 {
+		return s.ipv4
+	}
+	return s.ipv6
+}
+
+// getAssignedPrefixes retrives prefixes assigned to the node and returns them as a
+// list of BGP path.
+// using etcd directly since libcalico-go doesn't seem to have a method to return
+// assigned prefixes yet.
+// A node which has just joined may have no block assigned yet. It is not an
+// error; the blocks are advertised once watchPrefix sees them.
+func (s *Server) getAssignedPrefixes(api etcd.KeysAPI) ([]*bgptable.Path, uint64, error) {
+	var ps []*bgptable.Path
+	var index uint64
+	f := func(version string) error {
+		key := fmt.Sprintf("%s/%s/%s/block", CALICO_AGGR, os.Getenv(NODENAME), version)
+		res, err := api.Get(context.Background(), key, &etcd.GetOptions{Recursive: true})
+		if err != nil {
+			e, ok := err.(etcd.Error)
+			if !ok || e.Code != etcd.ErrorCodeKeyNotFound {
+				return err
+			}
+			log.Infof("no %s block assigned to this node yet", version)
+			if index == 0 {
+				index = e.Index
+			}
+			return nil
+		}
+		if index == 0 {
+		        index = res.Index
+		}
+		for _, v := range res.Node.Nodes {
+			path, err := s.makePath(etcdKeyToPrefix(v.Key), false)
+			if err != nil {
+				return err
+			}
+			ps = append(ps, path)
+		}
+		return nil
+	}
+	if s.ipv4 != nil {
+		if err := f("ipv4"); err != nil {
+			return nil, 0, err
+		}
+	}
+	if s.ipv6 != nil {
+		if err := f("ipv6"); err != nil {
+			return nil, 0, err
+		}
+	}
+	return ps, index, nil
+}
+
+// watchPrefix watches etcd /calico/ipam/v2/host/$NODENAME and add/delete
+// aggregated routes which are assigned to the node.
+// This function also updates policy appropriately.
+// When 'establishedWait' is positive, the initial prefixes are advertised
+// after a BGP session is established or 'establishedWait' passes.
+func (s *Server) watchPrefix(establishedWait time.Duration) error {
+	// the pools decide which prefixes are exported and how routes are
+	// encapsulated, so they are loaded first
+	if !s.ipam.waitReady(s.t.Dying()) {
+		return nil
+	}
+
+	paths, index, err := s.getAssignedPrefixes(s.etcd)
+	if err != nil {
+		return err
+	}
+
+	if err = s.updatePrefixSet(paths); err != nil {
+		return err
+	}
+
+	if establishedWait > 0 && !s.waitEstablished(establishedWait) {
+		log.Printf("no BGP session established in %s. advertising prefixes anyway", establishedWait)
+	}
+
+	if err := s.addBlockPaths(paths); err != nil {
+		return err
+	}
+	s.status.markSynced("prefix")
+
+	watcher, err := newStaleWatcher("prefix", s.etcd.Watcher(fmt.Sprintf("%s/%s", CALICO_AGGR, os.Getenv(NODENAME)), &etcd.WatcherOptions{Recursive: true, AfterIndex: index}))
+	if err != nil {
+		return err
+	}
+	for {
+		var err error
+		res, err := watcher.Next(context.Background())
+		if err != nil {
+			return err
+		}
+		s.waitMaintenance("prefix")
+		var path *bgptable.Path
+		key := etcdKeyToPrefix(res.Node.Key)
+		if res.Action == "delete" {
+			path, err = s.makePath(key, true)
+		} else {
+			path, err = s.makePath(key, false)
+		}
+		if _, ok := err.(*noNexthopError); ok {
+			log.Warnf("ignore %s: %s", key, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		paths := []*bgptable.Path{path}
+		if err = s.updatePrefixSet(paths); err != nil {
+			return err
+		}
+		if err := s.addBlockPaths(paths); err != nil {
+			return err
+		}
+		log.Printf("add path: %s", path)
+		s.status.markSynced("prefix")
+	}
+}
+
+// addBlockPaths adds the paths of the blocks assigned to this node, or of
+// the pools they cover when SUMMARIZE_POOLS is enabled
+func (s *Server) addBlockPaths(paths []*bgptable.Path) error {
+	ps := s.summarizer
+	if ps == nil {
+		return s.addPath(s.vrf, paths)
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	paths, err := ps.apply(paths)
+	if err != nil {
+		return err
+	}
+	if err = s.addPath(s.vrf, paths); err != nil {
+		return err
+	}
+	return ps.release()
+}
+
+// summarizePool is called when 'pool' is added, changed or deleted. The
+// blocks assigned before the pool was known are summarized now, and a
+// deleted pool is replaced by its blocks again.
+func (s *Server) summarizePool(pool *ipPool) error {
+	ps := s.summarizer
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	exists := false
+	if p := s.ipam.match(pool.CIDR); p != nil && p.CIDR == pool.CIDR {
+		exists = true
+	}
+	paths, err := ps.summarize(pool.CIDR, exists && ps.covered(pool.CIDR))
+	if err != nil {
+		return err
+	}
+	if err = s.addPath(s.vrf, paths); err != nil {
+		return err
+	}
+	return ps.release()
+}
+
+// poolSummarizer replaces the blocks of a pool by the pool itself while
+// all of its blocks are assigned to this node
+type poolSummarizer struct {
+	s *Server
+	// mu serializes the changes of the blocks and the pools, and the
+	// paths added for them
+	mu sync.Mutex
+	// blocks are the paths of the blocks assigned to this node
+	blocks map[string]*bgptable.Path
+	// summarized are the pools advertised instead of their blocks
+	summarized map[string]bool
+	// released are the pools withdrawn since the last call of release
+	released []string
+}
+
+func newPoolSummarizer(s *Server) *poolSummarizer {
+	return &poolSummarizer{
+		s:          s,
+		blocks:     make(map[string]*bgptable.Path),
+		summarized: make(map[string]bool),
+	}
+}
+
+// apply records the changes of the blocks in 'paths' and returns the
+// paths to add instead. A change of a block outside the pools is returned
+// as is. A pool becoming fully covered is advertised and its blocks are
+// withdrawn, and a summarized pool losing a block is withdrawn and its
+// remaining blocks are advertised.
+func (ps *poolSummarizer) apply(paths []*bgptable.Path) ([]*bgptable.Path, error) {
+	var ret []*bgptable.Path
+	for _, path := range paths {
+		prefix := path.GetNlri().String()
+		if path.IsWithdraw {
+			delete(ps.blocks, prefix)
+		} else {
+			ps.blocks[prefix] = path
+		}
+		pool := ps.s.ipam.match(prefix)
+		if pool == nil {
+			ret = append(ret, path)
+			continue
+		}
+		covered := ps.covered(pool.CIDR)
+		if covered != ps.summarized[pool.CIDR] {
+			paths, err := ps.summarize(pool.CIDR, covered)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, paths...)
+		} else if !covered {
+			ret = append(ret, path)
+		}
+	}
+	return ret, nil
+}
+
+// summarize returns the paths to add when 'pool' becomes covered, or
+// stops being covered, by the blocks of this node. A covered pool is
+// advertised and its blocks are withdrawn, and a pool no longer covered
+// is withdrawn after its blocks are advertised again.
+func (ps *poolSummarizer) summarize(pool string, covered bool) ([]*bgptable.Path, error) {
+	switch {
+	case covered && !ps.summarized[pool]:
+		supernet, err := ps.s.originatePaths([]string{pool})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("all blocks of pool %s are assigned. advertising the pool instead", pool)
+		ps.summarized[pool] = true
+		return append(supernet, ps.poolBlocks(pool, true)...), nil
+	case !covered && ps.summarized[pool]:
+		supernet, err := ps.s.makePath(pool, true)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("pool %s is partially assigned. advertising its blocks", pool)
+		delete(ps.summarized, pool)
+		ps.released = append(ps.released, pool)
+		// the blocks first, so that the traffic isn't dropped
+		return append(ps.poolBlocks(pool, false), supernet), nil
+	}
+	return nil, nil
+}
+
+// release removes the pools withdrawn by summarize from the 'aggregated'
+// set, once their withdrawals are added. A pool which is also a block of
+// this node is kept.
+func (ps *poolSummarizer) release() error {
+	for len(ps.released) > 0 {
+		pool := ps.released[0]
+		if _, ok := ps.blocks[pool]; !ok {
+			set, err := bgptable.NewPrefixSet(bgpconfig.PrefixSet{
+				PrefixSetName: aggregatedPrefixSetName,
+				PrefixList: []bgpconfig.Prefix{
+					bgpconfig.Prefix{
+						IpPrefix: pool,
+					},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			if err = ps.s.bgpServer.DeleteDefinedSet(set, false); err != nil {
+				return err
+			}
+		}
+		ps.released = ps.released[1:]
+	}
+	return nil
+}
+
+// poolBlocks returns the paths of the blocks in 'pool', as withdrawals
+// when 'withdraw' is true
+func (ps *poolSummarizer) poolBlocks(pool string, withdraw bool) []*bgptable.Path {
+	_, poolNet, _ := net.ParseCIDR(pool)
+	var ret []*bgptable.Path
+	for prefix, path := range ps.blocks {
+		if _, ipNet, err := net.ParseCIDR(prefix); err == nil && poolNet.Contains(ipNet.IP) {
+			if withdraw {
+				path = path.Clone(true)
+			}
+			ret = append(ret, path)
+		}
+	}
+	return ret
+}
+
+// covered returns true if the blocks assigned to this node cover 'pool'.
+// The blocks of a pool don't overlap, so it compares the sum of their
+// sizes with the size of the pool. Pools of more than 2^32 addresses are
+// never covered in practice and aren't summarized.
+func (ps *poolSummarizer) covered(pool string) bool {
+	_, poolNet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return false
+	}
+	ones, bits := poolNet.Mask.Size()
+	if bits-ones > 32 {
+		return false
+	}
+	var total uint64
+	for prefix := range ps.blocks {
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil || !poolNet.Contains(ipNet.IP) {
+			continue
+		}
+		n, _ := ipNet.Mask.Size()
+		if n < ones {
+			continue
+		}
+		total += 1 << uint(bits-n)
+	}
+	return total == 1<<uint(bits-ones)
+}
+
+// advertiseDefaultRoutes originates 0.0.0.0/0 and ::/0 for the address
+// families this node has an address of.
+// They are withdrawn when the daemon stops.
+func (s *Server) advertiseDefaultRoutes() error {
+	var prefixes []string
+	if s.ipv4 != nil {
+		prefixes = append(prefixes, "0.0.0.0/0")
+	}
+	if s.ipv6 != nil {
+		prefixes = append(prefixes, "::/0")
+	}
+	for _, prefix := range prefixes {
+		log.Warnf("advertising default route %s to all neighbors", prefix)
+	}
+	return s.advertisePrefixes(prefixes)
+}
+
+// advertiseLoopback originates the host route of the loopback address
+func (s *Server) advertiseLoopback() error {
+	prefix := fmt.Sprintf("%s/32", s.loopback)
+	if s.loopback.To4() == nil {
+		prefix = fmt.Sprintf("%s/128", s.loopback)
+	}
+	log.Printf("advertising loopback %s", prefix)
+	return s.advertisePrefixes([]string{prefix})
+}
+
+// advertiseAnycast originates the host routes of the anycast addresses
+// 'addrs'. They are withdrawn like any other prefix when the daemon drains
+// or stops.
+func (s *Server) advertiseAnycast(addrs []string) error {
+	var prefixes []string
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid %s: %s", ANYCAST_ADDRESSES, addr)
+		}
+		prefix := fmt.Sprintf("%s/32", ip)
+		if ip.To4() == nil {
+			prefix = fmt.Sprintf("%s/128", ip)
+		}
+		log.Printf("advertising anycast address %s", prefix)
+		prefixes = append(prefixes, prefix)
+	}
+	return s.advertisePrefixes(prefixes)
+}
+
+// parseCommunity parses a community in the "AS:value" format
+func parseCommunity(v string) (uint32, error) {
+	elems := strings.Split(v, ":")
+	if len(elems) != 2 {
+		return 0, fmt.Errorf("invalid community %q", v)
+	}
+	hi, err := strconv.ParseUint(elems[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q", v)
+	}
+	lo, err := strconv.ParseUint(elems[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %q", v)
+	}
+	return uint32(hi<<16 | lo), nil
+}
+
+// advertiseBlackholes originates the given prefixes with the blackhole
+// community and next hop
+func (s *Server) advertiseBlackholes(prefixes []string) error {
+	v := os.Getenv(BLACKHOLE_COMMUNITY)
+	if v == "" {
+		v = defaultBlackholeCommunity
+	}
+	comm, err := parseCommunity(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", BLACKHOLE_COMMUNITY, err)
+	}
+	var list []string
+	for _, prefix := range prefixes {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			list = append(list, prefix)
+		}
+	}
+	nexthops, err := getBlackholeNexthops(list)
+	if err != nil {
+		return err
+	}
+	paths, err := s.originatePaths(list)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		path.SetCommunities([]uint32{comm}, false)
+		if nexthop, ok := nexthops[path.GetRouteFamily() == bgp.RF_IPv4_UC]; ok {
+			path.SetNexthop(nexthop)
+		}
+		log.Warnf("advertising blackhole route %s", path)
+	}
+	return s.advertisePathSet(staticPathSet, paths)
+}
+
+// getBlackholeNexthops returns the next hops in BLACKHOLE_NEXTHOP keyed by
+// whether they are IPv4. When it is set, a prefix in 'prefixes' of a
+// family it has no address of is an error rather than being advertised
+// with this node's address.
+func getBlackholeNexthops(prefixes []string) (map[bool]net.IP, error) {
+	nexthops := make(map[bool]net.IP)
+	v := os.Getenv(BLACKHOLE_NEXTHOP)
+	if v == "" {
+		return nexthops, nil
+	}
+	for _, addr := range strings.Split(v, ",") {
+		nexthop := net.ParseIP(strings.TrimSpace(addr))
+		if nexthop == nil {
+			return nil, fmt.Errorf("invalid %s: %s", BLACKHOLE_NEXTHOP, addr)
+		}
+		v4 := nexthop.To4() != nil
+		if _, ok := nexthops[v4]; ok {
+			return nil, fmt.Errorf("invalid %s: more than one address of the family of %s", BLACKHOLE_NEXTHOP, nexthop)
+		}
+		nexthops[v4] = nexthop
+	}
+	for _, prefix := range prefixes {
+		ip, _, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := nexthops[ip.To4() != nil]; !ok {
+			return nil, fmt.Errorf("invalid %s: no address of the family of %s", BLACKHOLE_NEXTHOP, prefix)
+		}
+	}
+	return nexthops, nil
+}
+
+// advertiseCanaries originates the given prefixes in the canary path set
+func (s *Server) advertiseCanaries(prefixes []string) error {
+	var list []string
+	for _, prefix := range prefixes {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			log.Printf("advertising canary route %s", prefix)
+			list = append(list, prefix)
+		}
+	}
+	paths, err := s.originatePaths(list)
+	if err != nil {
+		return err
+	}
+	return s.advertisePathSet(canaryPathSet, paths)
+}
+
+// watchCanarySignal withdraws the canary path set when SIGHUP is received
+func (s *Server) watchCanarySignal() error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ch:
+			if err := s.WithdrawPathSet(canaryPathSet); err != nil {
+				log.Errorf("failed to withdraw the canary routes: %s", err)
+			}
+		case <-s.t.Dying():
+			return nil
+		}
+	}
+}
+
+// advertisePrefixes originates the given prefixes.
+func (s *Server) advertisePrefixes(prefixes []string) error {
+	paths, err := s.originatePaths(prefixes)
+	if err != nil {
+		return err
+	}
+	return s.advertisePathSet(staticPathSet, paths)
+}
+
+// advertisePathSet adds the paths and records them in the path set 'name'
+func (s *Server) advertisePathSet(name string, paths []*bgptable.Path) error {
+	if err := s.addPath("", paths); err != nil {
+		return err
+	}
+	s.pathSetMu.Lock()
+	defer s.pathSetMu.Unlock()
+	if s.pathSets == nil {
+		s.pathSets = make(map[string][]*bgptable.Path)
+	}
+	s.pathSets[name] = append(s.pathSets[name], paths...)
+	return nil
+}
+
+// WithdrawPathSet withdraws every path in the path set 'name', leaving the
+// other advertisements untouched
+func (s *Server) WithdrawPathSet(name string) error {
+	s.pathSetMu.Lock()
+	defer s.pathSetMu.Unlock()
+	paths := s.pathSets[name]
+	if len(paths) == 0 {
+		return nil
+	}
+	withdrawn := make([]*bgptable.Path, 0, len(paths))
+	for _, path := range paths {
+		withdrawn = append(withdrawn, path.Clone(true))
+	}
+	log.Printf("withdrawing %d path(s) of path set %s", len(withdrawn), name)
+	if err := s.addPath("", withdrawn); err != nil {
+		return err
+	}
+	delete(s.pathSets, name)
+	return nil
+}
+
+// originatePaths returns the paths of the given prefixes. The prefixes are
+// only added to the 'aggregated' set, so that they don't filter out any
+// longer prefix.
+func (s *Server) originatePaths(prefixes []string) ([]*bgptable.Path, error) {
+	paths := make([]*bgptable.Path, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		ps, err := bgptable.NewPrefixSet(bgpconfig.PrefixSet{
+			PrefixSetName: aggregatedPrefixSetName,
+			PrefixList: []bgpconfig.Prefix{
+				bgpconfig.Prefix{
+					IpPrefix: prefix,
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = s.bgpServer.AddDefinedSet(ps); err != nil {
+			return nil, err
+		}
+		path, err := s.makePath(prefix, false)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// addNeighbors adds the neighbors using up to 'concurrency' goroutines.
+// A neighbor which can't be added doesn't prevent the others from being
+// added. The returned error lists every neighbor which failed.
+func (s *Server) addNeighbors(ns []*bgpconfig.Neighbor, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	ch := make(chan *bgpconfig.Neighbor)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range ch {
+				if err := s.addNeighbor(n); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Sprintf("%s: %s", n.Config.NeighborAddress, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, n := range ns {
+		ch <- n
+	}
+	close(ch)
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to add %d neighbor(s): %s", len(errs), strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// churnBreaker trips when more than 'threshold' changes are recorded
+// within 'window'
+type churnBreaker struct {
+	threshold int
+	window    time.Duration
+	start     time.Time
+	count     int
+}
+
+func newChurnBreaker() (*churnBreaker, error) {
+	threshold, err := getIntFromEnv(CHURN_THRESHOLD, 0)
+	if err != nil {
+		return nil, err
+	}
+	window, err := getDurationFromEnv(CHURN_WINDOW, defaultChurnWindow)
+	if err != nil {
+		return nil, err
+	}
+	return &churnBreaker{threshold: threshold, window: window}, nil
+}
+
+// record records a change at 'now' and returns true if the breaker trips.
+// The count starts over once the breaker trips.
+func (b *churnBreaker) record(now time.Time) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+	if now.Sub(b.start) > b.window {
+		b.start = now
+		b.count = 0
+	}
+	b.count++
+	if b.count > b.threshold {
+		b.start = time.Time{}
+		return true
+	}
+	return false
+}
+
+// handlePeerChange applies the change 'res' of a global or node-specific
+// peer. A protected global peer keeps its session when it is deleted, or
+// when its address changes, in which case the new address is added too.
+// A peer which supports route refresh keeps its session when other settings
+// change; the others are deleted and added again.
+func (s *Server) handlePeerChange(res *etcd.Response, neighborType string, localAS uint32) error {
+	protected := false
+	if neighborType == "global" && res.PrevNode != nil {
+		if m, err := parsePeerConfig([]byte(res.PrevNode.Value)); err == nil {
+			protected = m.Protected
+		}
+	}
+	switch res.Action {
+	case "delete":
+		n, err := s.getNeighborConfigFromPeer(res.PrevNode, neighborType, localAS)
+		if err != nil {
+			return err
+		}
+		if protected {
+			log.Warnf("global peer %s is protected. keep it until it is re-created with \"protected\": false and deleted", n.Config.NeighborAddress)
+			return nil
+		}
+		return s.deleteNeighbor(n)
+	case "set", "create", "update", "compareAndSwap":
+		n, err := s.getNeighborConfigFromPeer(res.Node, neighborType, localAS)
+		if err != nil {
+			return err
+		}
+		// re-apply the neighbor so that changed settings take effect
+		if res.PrevNode != nil {
+			if onlyProtectionChanged(res.PrevNode.Value, res.Node.Value) {
+				log.Printf("protection of peer %s changed. keep the session", n.Config.NeighborAddress)
+				return nil
+			}
+			prev, err := s.getNeighborConfigFromPeer(res.PrevNode, neighborType, localAS)
+			if err != nil {
+				return err
+			}
+			if protected && prev.Config.NeighborAddress != n.Config.NeighborAddress {
+				log.Warnf("global peer %s is protected. keep it while adding its new address %s", prev.Config.NeighborAddress, n.Config.NeighborAddress)
+				return s.addNeighbor(n)
+			}
+			if prev.Config.NeighborAddress == n.Config.NeighborAddress && s.canRefresh(n.Config.NeighborAddress) {
+				return s.refreshNeighbor(prev, n)
+			}
+			return s.replaceNeighbor(prev, n)
+		}
+		return s.addNeighbor(n)
+	}
+	log.Printf("unhandled action: %s", res.Action)
+	return nil
+}
+
+// watchBGPConfig watches etcd path /calico/bgp/v1 and handle various changes
+// in etcd. Though this method tries to minimize effects to the existing BGP peers,
+// when /calico/bgp/v1/host/$NODENAME or /calico/global/as_num is changed,
+// give up handling the change and return error (this leads calico-bgp-daemon to be restarted)
+func (s *Server) watchBGPConfig() error {
+	var index uint64
+	res, err := s.etcd.Get(context.Background(), CALICO_BGP, nil)
+	if err != nil {
+		return err
+	}
+	index = res.Index
+
+	neighborConfigs, err := s.getNeighborConfigs()
+	if err != nil {
+		return err
+	}
+
+	concurrency, err := getIntFromEnv(NEIGHBOR_CONCURRENCY, defaultNeighborConcurrency)
+	if err != nil {
+		return err
+	}
+	if err = s.addNeighbors(neighborConfigs, concurrency); err != nil {
+		log.Error(err)
+	}
+	s.status.markSynced("bgpconfig")
+
+	breaker, err := newChurnBreaker()
+	if err != nil {
+		return err
+	}
+	cooldown, err := getDurationFromEnv(CHURN_COOLDOWN, defaultChurnCooldown)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := newStaleWatcher("bgpconfig", s.etcd.Watcher(CALICO_BGP, &etcd.WatcherOptions{Recursive: true, AfterIndex: index}))
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := watcher.Next(context.Background())
+		if err != nil {
+			return err
+		}
+		s.waitMaintenance("bgpconfig")
+		// changes are not lost while pausing, the watcher resumes from
+		// the index it stopped at
+		if breaker.record(time.Now()) {
+			log.Warnf("more than %d BGP configuration changes within %s. pause handling them for %s", breaker.threshold, breaker.window, cooldown)
+			select {
+			case <-time.After(cooldown):
+			case <-s.t.Dying():
+				return nil
+			}
+		}
+		prev := ""
+		if res.PrevNode != nil {
+			prev = res.PrevNode.Value
+		}
+		log.Printf("watch: action: %s, key: %s node: %s, prev-node: %s", res.Action, res.Node.Key, res.Node.Value, prev)
+		if res.Action == "set" && res.Node.Value == prev {
+			log.Printf("same value. ignore")
+			continue
+		}
+
+		handleNonMeshNeighbor := func(neighborType string) error {
+			localAS, err := s.getNodeASN()
+			if err != nil {
+				return err
+			}
+			return s.handlePeerChange(res, neighborType, uint32(localAS))
+		}
+
+		key := res.Node.Key
+		switch {
+		case strings.HasPrefix(key, fmt.Sprintf("%s/global/peer_", CALICO_BGP)):
+			err = handleNonMeshNeighbor("global")
+		case strings.HasPrefix(key, fmt.Sprintf("%s/host/%s/peer_", CALICO_BGP, os.Getenv(NODENAME))):
 			err = handleNonMeshNeighbor("node")
 		case strings.HasPrefix(key, fmt.Sprintf("%s/host/%s", CALICO_BGP, os.Getenv(NODENAME))):
 			log.Println("Local host config update. Restart")
@@ -682,115 +3348,1330 @@ func (s *Server) watchBGPConfig() error {
 				log.Printf("unhandled key: %s", key)
 				continue
 			}
-			deleteNeighbor := func(node *etcd.Node) error {
-				if node.Value == "" {
-					return nil
-				}
-				n := &bgpconfig.Neighbor{
-					Config: bgpconfig.NeighborConfig{
-						NeighborAddress: node.Value,
-					},
-				}
-				return s.bgpServer.DeleteNeighbor(n)
+			deleteNeighbor := func(node *etcd.Node) error {
+				if node.Value == "" {
+					return nil
+				}
+				n := &bgpconfig.Neighbor{
+					Config: bgpconfig.NeighborConfig{
+						NeighborAddress: normalizeAddress(node.Value),
+					},
+				}
+				return s.deleteNeighbor(n)
+			}
+			mesh, err := s.getMeshConfig()
+			if err != nil {
+				return err
+			}
+			host := elems[len(elems)-2]
+			if !meshHostAllowed(host) {
+				log.Printf("%s is excluded from the mesh. ignore", host)
+				continue
+			}
+			switch elems[len(elems)-1] {
+			case "ip_addr_v4", "ip_addr_v6":
+				if !mesh.enabled(elems[len(elems)-1] == "ip_addr_v4") {
+					continue
+				}
+				switch res.Action {
+				case "delete":
+					if err = deleteNeighbor(res.PrevNode); err != nil {
+						return err
+					}
+				case "set":
+					if res.PrevNode != nil {
+						if err = deleteNeighbor(res.PrevNode); err != nil {
+							return err
+						}
+					}
+					if res.Node.Value == "" {
+						continue
+					}
+					// a host with a broken AS number doesn't block the others
+					asn, err := s.getPeerASN(host)
+					if err != nil {
+						log.Errorf("failed to get the AS number of %s. skip its mesh neighbor: %s", host, err)
+						continue
+					}
+					ip := normalizeAddress(res.Node.Value)
+					n := s.newMeshNeighbor(ip, uint32(asn))
+					if err = s.addNeighbor(n); err != nil {
+						return err
+					}
+				}
+			case "as_num":
+				if err = s.updateMeshASN(host, mesh); err != nil {
+					return err
+				}
+			default:
+				log.Printf("unhandled key: %s", key)
+			}
+		case strings.HasPrefix(key, fmt.Sprintf("%s/global/as_num", CALICO_BGP)):
+			log.Println("Global AS number update. Restart")
+			os.Exit(1)
+		case strings.HasPrefix(key, fmt.Sprintf("%s/global/node_mesh", CALICO_BGP)):
+			// only touch the families whose mesh state actually changed
+			prev, cur := &s.defaultMesh, &s.defaultMesh
+			if res.PrevNode != nil {
+				if prev, err = parseMeshConfig(res.PrevNode.Value); err != nil {
+					return err
+				}
+			}
+			if res.Action != "delete" {
+				if cur, err = parseMeshConfig(res.Node.Value); err != nil {
+					return err
+				}
+			}
+			ns, err := s.getMeshNeighborConfigs(&meshConfig{Enabled: true})
+			if err != nil {
+				return err
+			}
+			if err = s.updateMeshFamilies(ns, prev, cur); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+		s.status.markSynced("bgpconfig")
+	}
+}
+
+// observe logs an operation skipped in observe-only mode, and counts it as
+// 'op' for the status file
+func (s *Server) observe(op, format string, args ...interface{}) {
+	log.Printf("observe-only: "+format, args...)
+	s.observedMu.Lock()
+	defer s.observedMu.Unlock()
+	if s.observed == nil {
+		s.observed = make(map[string]int)
+	}
+	s.observed[op]++
+}
+
+// observedCounts returns a copy of the number of operations of each kind
+// skipped in observe-only mode
+func (s *Server) observedCounts() map[string]int {
+	s.observedMu.Lock()
+	defer s.observedMu.Unlock()
+	m := make(map[string]int, len(s.observed))
+	for op, n := range s.observed {
+		m[op] = n
+	}
+	return m
+}
+
+// addNeighbor adds a neighbor to the BGP server.
+// In observe-only mode, it only logs the neighbor.
+func (s *Server) addNeighbor(n *bgpconfig.Neighbor) error {
+	if s.observeOnly {
+		s.observe("add_neighbor", "add neighbor %s (AS %d)", n.Config.NeighborAddress, n.Config.PeerAs)
+		return nil
+	}
+	// adding a neighbor which exists already, e.g. when a partial apply
+	// is retried, updates it instead of failing
+	if ns := s.bgpServer.GetNeighbor(n.Config.NeighborAddress, false); len(ns) > 0 {
+		return s.updateNeighbor(ns[0], n)
+	}
+	if s.maxNeighbors > 0 {
+		s.neighborMu.Lock()
+		defer s.neighborMu.Unlock()
+		if count := len(s.bgpServer.GetNeighbor("", false)); count >= s.maxNeighbors {
+			log.Errorf("skip neighbor %s: already %d neighbors, the maximum set by %s", n.Config.NeighborAddress, count, MAX_NEIGHBORS)
+			neighborsSkippedMetric.Add(1)
+			return nil
+		}
+	}
+	if err := s.updatePrepend(n, false); err != nil {
+		return err
+	}
+	return s.retryNeighbor("add", n, s.bgpServer.AddNeighbor)
+}
+
+// updateNeighbor applies the configuration 'n' to the existing neighbor
+// 'prev'. gobgp only resets what has changed, so it is a no-op when the
+// configuration is the same.
+// In observe-only mode, it only logs the neighbor.
+func (s *Server) updateNeighbor(prev, n *bgpconfig.Neighbor) error {
+	if s.observeOnly {
+		s.observe("update_neighbor", "update neighbor %s (AS %d)", n.Config.NeighborAddress, n.Config.PeerAs)
+		return nil
+	}
+	if err := s.updatePrepend(prev, true); err != nil {
+		return err
+	}
+	if err := s.updatePrepend(n, false); err != nil {
+		return err
+	}
+	var softResetIn bool
+	err := s.retryNeighbor("update", n, func(n *bgpconfig.Neighbor) error {
+		var err error
+		softResetIn, err = s.bgpServer.UpdateNeighbor(n)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Debugf("neighbor %s exists already. updated it", n.Config.NeighborAddress)
+	if softResetIn {
+		if err := s.bgpServer.SoftResetIn(n.Config.NeighborAddress, 0); err != nil {
+			return err
+		}
+	}
+	// the routes advertised already went through the previous prepend policy
+	if prependCount(prev) != prependCount(n) && prev.State.SessionState == bgpconfig.SESSION_STATE_ESTABLISHED {
+		return s.SoftResetNeighbor(n.Config.NeighborAddress, bgptable.POLICY_DIRECTION_EXPORT)
+	}
+	return nil
+}
+
+func prependPolicyName(count uint8) string {
+	return fmt.Sprintf("%s%d", prependPolicyPrefix, count)
+}
+
+// prependSetName returns the name of the export policy, and of its
+// neighbor-set, which prepends 'asn' 'count' times
+func prependSetName(asn uint32, count uint8) string {
+	return fmt.Sprintf("%s%d_as%d", prependPolicyPrefix, count, asn)
+}
+
+// prependCount returns the AS-path prepend count of the neighbor 'n'
+func prependCount(n *bgpconfig.Neighbor) uint8 {
+	for _, name := range n.ApplyPolicy.Config.ExportPolicyList {
+		var count uint8
+		if _, err := fmt.Sscanf(name, prependPolicyPrefix+"%d", &count); err == nil {
+			return count
+		}
+	}
+	return 0
+}
+
+// updatePrepend adds the neighbor 'n' to, or deletes it from, the
+// neighbor-set of the export policy which prepends the local AS of its
+// session as many times as 'n' is configured to. The local AS is the one
+// of the BGP server unless 'n' overrides it, as IPv6 sessions do with
+// IPV6_AS. A policy is shared by all the neighbors with the same local AS
+// and count, and is evaluated before the 'calico_aggr' policy accepts the
+// routes.
+func (s *Server) updatePrepend(n *bgpconfig.Neighbor, del bool) error {
+	count := prependCount(n)
+	if count == 0 {
+		return nil
+	}
+	asn := n.Config.LocalAs
+	if asn == 0 {
+		asn = s.bgpServer.GetServer().Config.As
+	}
+	name := prependSetName(asn, count)
+	ns, err := bgptable.NewNeighborSet(bgpconfig.NeighborSet{
+		NeighborSetName:  name,
+		NeighborInfoList: []string{n.Config.NeighborAddress},
+	})
+	if err != nil {
+		return err
+	}
+	if del {
+		return s.bgpServer.DeleteDefinedSet(ns, false)
+	}
+
+	s.prependMu.Lock()
+	defer s.prependMu.Unlock()
+	if s.prependPolicies[name] {
+		return s.bgpServer.AddDefinedSet(ns)
+	}
+	if err = s.bgpServer.AddDefinedSet(ns); err != nil {
+		return err
+	}
+	definition := bgpconfig.PolicyDefinition{
+		Name: name,
+		Statements: []bgpconfig.Statement{
+			bgpconfig.Statement{
+				Conditions: bgpconfig.Conditions{
+					MatchNeighborSet: bgpconfig.MatchNeighborSet{
+						NeighborSet: name,
+					},
+				},
+				Actions: bgpconfig.Actions{
+					BgpActions: bgpconfig.BgpActions{
+						SetAsPathPrepend: bgpconfig.SetAsPathPrepend{
+							As:      strconv.FormatUint(uint64(asn), 10),
+							RepeatN: count,
+						},
+					},
+				},
+			},
+		},
+	}
+	policy, err := bgptable.NewPolicy(definition)
+	if err != nil {
+		return err
+	}
+	if err = s.bgpServer.AddPolicy(policy, false); err != nil {
+		return err
+	}
+	if s.prependPolicies == nil {
+		s.prependPolicies = make(map[string]bool)
+	}
+	s.prependPolicies[name] = true
+	// the prepend policies precede 'calico_aggr', whose statements accept
+	// or reject the routes and end the evaluation
+	policies := make([]*bgpconfig.PolicyDefinition, 0, len(s.prependPolicies)+2)
+	if !s.exportLearned {
+		policies = append(policies, &bgpconfig.PolicyDefinition{Name: originatedPolicyName})
+	}
+	for prepend := range s.prependPolicies {
+		policies = append(policies, &bgpconfig.PolicyDefinition{Name: prepend})
+	}
+	policies = append(policies, &bgpconfig.PolicyDefinition{Name: aggrPolicyName})
+	return s.bgpServer.ReplacePolicyAssignment("", bgptable.POLICY_DIRECTION_EXPORT, policies, bgptable.ROUTE_TYPE_ACCEPT)
+}
+
+// permanentNeighborErrors are the beginnings of the messages of the errors
+// which the neighbor operations of gobgp v1.22 fail with however many times
+// they are retried. gobgp returns plain formatted errors, which have no
+// value or type to compare with.
+var permanentNeighborErrors = []string{
+	// AddNeighbor of an address which has a neighbor already
+	"Can't overwrite the existing peer: ",
+	// DeleteNeighbor of an address which has no neighbor
+	"Can't delete a peer configuration for ",
+	// UpdateNeighbor of an address which has no neighbor
+	"Neighbor that has ",
+	// a neighbor without an address
+	"NeighborAddress is not configured",
+	// a neighbor with an unknown address family
+	"invalid AfiSafiType: ",
+}
+
+// isPermanentNeighborError returns true if retrying the neighbor operation
+// which failed with 'err' can't succeed
+func isPermanentNeighborError(err error) bool {
+	msg := err.Error()
+	for _, prefix := range permanentNeighborErrors {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryNeighbor calls 'f' with 'n' until it succeeds, fails permanently,
+// s.neighborRetries retries are exhausted or the daemon stops, doubling the
+// backoff each time
+func (s *Server) retryNeighbor(op string, n *bgpconfig.Neighbor, f func(*bgpconfig.Neighbor) error) error {
+	backoff := neighborRetryBackoff
+	for i := 0; ; i++ {
+		err := f(n)
+		if err == nil || i >= s.neighborRetries || isPermanentNeighborError(err) {
+			return err
+		}
+		log.Warnf("failed to %s neighbor %s, retrying in %s: %s", op, n.Config.NeighborAddress, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-s.t.Dying():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// canRefresh returns true if the session with the neighbor at 'addr' is
+// established and has route refresh negotiated
+func (s *Server) canRefresh(addr string) bool {
+	ns := s.getNeighbors(addr)
+	return len(ns) > 0 && ns[0].State.SessionState == bgpconfig.SESSION_STATE_ESTABLISHED && supportsRouteRefresh(ns[0])
+}
+
+// getNeighbors returns the neighbor at 'addr', or all the neighbors when
+// 'addr' is empty, with the state of their sessions
+func (s *Server) getNeighbors(addr string) []*bgpconfig.Neighbor {
+	if s.neighbors != nil {
+		return s.neighbors(addr)
+	}
+	return s.bgpServer.GetNeighbor(addr, false)
+}
+
+// refreshNeighbor applies the changed settings 'n' of the neighbor 'prev'
+// in place, and re-evaluates the routes exchanged with it by route
+// refresh. Unlike replaceNeighbor, it keeps the session, so the address
+// must be the same and the peer must support route refresh.
+func (s *Server) refreshNeighbor(prev, n *bgpconfig.Neighbor) error {
+	if err := s.updateNeighbor(prev, n); err != nil {
+		return err
+	}
+	// POLICY_DIRECTION_NONE resets both directions
+	return s.SoftResetNeighbor(n.Config.NeighborAddress, bgptable.POLICY_DIRECTION_NONE)
+}
+
+// replaceNeighbor replaces the neighbor 'prev' with 'n' so that changed
+// settings take effect
+func (s *Server) replaceNeighbor(prev, n *bgpconfig.Neighbor) error {
+	if s.observeOnly {
+		s.observe("replace_neighbor", "replace neighbor %s with %s (AS %d)", prev.Config.NeighborAddress, n.Config.NeighborAddress, n.Config.PeerAs)
+		return nil
+	}
+	if err := s.retryNeighbor("delete", prev, s.bgpServer.DeleteNeighbor); err != nil {
+		return err
+	}
+	if err := s.updatePrepend(prev, true); err != nil {
+		return err
+	}
+	if err := s.updatePrepend(n, false); err != nil {
+		return err
+	}
+	return s.retryNeighbor("add", n, s.bgpServer.AddNeighbor)
+}
+
+// addPath adds or withdraws paths from the RIB of 'vrf', or the global RIB
+// when 'vrf' is empty. The paths of the prefixes withdrawn by
+// WithdrawPrefix are kept until ReAdvertise is called.
+// In observe-only mode, it only logs the paths.
+func (s *Server) addPath(vrf string, paths []*bgptable.Path) error {
+	paths = s.suppressWithdrawn(vrf, paths)
+	if len(paths) == 0 {
+		return nil
+	}
+	if s.observeOnly {
+		for _, path := range paths {
+			if path.IsWithdraw {
+				s.observe("withdraw_path", "withdraw path %s", path)
+			} else {
+				s.observe("add_path", "add path %s", path)
+			}
+		}
+		return nil
+	}
+	s.pathIDMu.Lock()
+	defer s.pathIDMu.Unlock()
+	if s.pathIDs == nil {
+		s.pathIDs = make(map[pathKey][]byte)
+	}
+	// AddPath returns an identifier only when it is given a single path,
+	// so the paths are added one by one
+	for _, path := range paths {
+		key := pathKey{vrf: vrf, prefix: path.GetNlri().String()}
+		if !path.IsWithdraw {
+			// the export policy evaluates the path as soon as it's added
+			if err := s.updateOriginatedSet(vrf, key.prefix, false); err != nil {
+				return err
+			}
+			// gobgp keeps every identifier it returned until it's deleted,
+			// and resolves it to the prefix. deleting the identifier of a
+			// prefix advertised again withdraws the previous path first.
+			if id, ok := s.pathIDs[key]; ok {
+				if err := s.bgpServer.DeletePath(id, 0, vrf, nil); err != nil {
+					return err
+				}
+				delete(s.pathIDs, key)
+			}
+		} else if id, ok := s.pathIDs[key]; ok {
+			if err := s.bgpServer.DeletePath(id, 0, vrf, nil); err != nil {
+				return err
+			}
+			delete(s.pathIDs, key)
+			if err := s.updateOriginatedSet(vrf, key.prefix, true); err != nil {
+				return err
+			}
+			continue
+		}
+		id, err := s.bgpServer.AddPath(vrf, []*bgptable.Path{path})
+		if err != nil {
+			return err
+		}
+		if !path.IsWithdraw {
+			s.pathIDs[key] = id
+			continue
+		}
+		if err := s.updateOriginatedSet(vrf, key.prefix, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateOriginatedSet adds the exact prefix of a path advertised in the
+// global RIB to the 'originated' prefix-set, or deletes it when the path is
+// withdrawn. The set is only used when the learned routes aren't exported.
+func (s *Server) updateOriginatedSet(vrf, prefix string, del bool) error {
+	if s.exportLearned || vrf != "" {
+		return nil
+	}
+	ps, err := bgptable.NewPrefixSet(bgpconfig.PrefixSet{
+		PrefixSetName: originatedPrefixSetName,
+		PrefixList: []bgpconfig.Prefix{
+			bgpconfig.Prefix{
+				IpPrefix: prefix,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if del {
+		return s.bgpServer.DeleteDefinedSet(ps, false)
+	}
+	return s.bgpServer.AddDefinedSet(ps)
+}
+
+// suppressWithdrawn returns the paths whose prefix isn't withdrawn by
+// WithdrawPrefix, and keeps the others to be advertised by ReAdvertise
+func (s *Server) suppressWithdrawn(vrf string, paths []*bgptable.Path) []*bgptable.Path {
+	s.withdrawnMu.Lock()
+	defer s.withdrawnMu.Unlock()
+	if len(s.withdrawn) == 0 {
+		return paths
+	}
+	ret := make([]*bgptable.Path, 0, len(paths))
+	for _, path := range paths {
+		prefix := path.GetNlri().String()
+		if _, ok := s.withdrawn[prefix]; !ok {
+			ret = append(ret, path)
+			continue
+		}
+		if path.IsWithdraw {
+			s.withdrawn[prefix] = &suppressedPath{}
+		} else {
+			s.withdrawn[prefix] = &suppressedPath{vrf: vrf, path: path}
+			log.Printf("keep %s withdrawn", prefix)
+		}
+	}
+	return ret
+}
+
+// WithdrawPrefix withdraws 'cidr' from the global RIB and the VRF, and keeps
+// it withdrawn, whatever the configuration says, until ReAdvertise is
+// called
+func (s *Server) WithdrawPrefix(cidr string) error {
+	path, err := s.makePath(cidr, true)
+	if err != nil {
+		return err
+	}
+	prefix := path.GetNlri().String()
+	s.withdrawnMu.Lock()
+	_, ok := s.withdrawn[prefix]
+	s.withdrawnMu.Unlock()
+	if ok {
+		return nil
+	}
+	// the path to restore by ReAdvertise
+	current := s.localPath(prefix)
+	vrfs := []string{""}
+	if s.vrf != "" {
+		vrfs = append(vrfs, s.vrf)
+	}
+	for _, vrf := range vrfs {
+		if err = s.addPath(vrf, []*bgptable.Path{path}); err != nil {
+			return err
+		}
+	}
+	s.withdrawnMu.Lock()
+	defer s.withdrawnMu.Unlock()
+	if s.withdrawn == nil {
+		s.withdrawn = make(map[string]*suppressedPath)
+	}
+	s.withdrawn[prefix] = current
+	log.Warnf("withdrew %s administratively", prefix)
+	return nil
+}
+
+// localPath returns the path of 'prefix' originated in the global RIB
+func (s *Server) localPath(prefix string) *suppressedPath {
+	paths, err := s.AdvertisedPaths()
+	if err != nil {
+		return &suppressedPath{}
+	}
+	for _, path := range paths {
+		if path.GetNlri().String() == prefix {
+			return &suppressedPath{path: path}
+		}
+	}
+	return &suppressedPath{}
+}
+
+// ReAdvertise lets 'cidr' be advertised again after WithdrawPrefix, and
+// advertises the path the configuration asked for meanwhile, if any
+func (s *Server) ReAdvertise(cidr string) error {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	prefix := ipNet.String()
+	s.withdrawnMu.Lock()
+	p, ok := s.withdrawn[prefix]
+	delete(s.withdrawn, prefix)
+	s.withdrawnMu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not withdrawn", prefix)
+	}
+	log.Printf("re-advertise %s", prefix)
+	if p.path == nil {
+		return nil
+	}
+	return s.addPath(p.vrf, []*bgptable.Path{p.path})
+}
+
+// watchWithdrawnFile calls WithdrawPrefix for the prefixes listed in the
+// file at 'path', and ReAdvertise for the prefixes no longer listed, every
+// withdrawnCheckInterval. A file which can't be parsed is left unapplied.
+func (s *Server) watchWithdrawnFile(path string) error {
+	errs, err := newErrorLimiter()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(withdrawnCheckInterval)
+	defer ticker.Stop()
+	listed := make(map[string]bool)
+	for {
+		if cur, err := readPrefixFile(path); err != nil {
+			errs.log(log.Warnf, fmt.Sprintf("failed to read %s: %s", path, err))
+		} else {
+			errs.reset(fmt.Sprintf("read %s again", path))
+			listed = s.applyWithdrawn(listed, cur)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.t.Dying():
+			return nil
+		}
+	}
+}
+
+// applyWithdrawn withdraws the prefixes in 'cur' which aren't in 'prev',
+// and re-advertises those in 'prev' which aren't in 'cur'. It returns the
+// prefixes withdrawn now; the ones which failed are tried again next time.
+func (s *Server) applyWithdrawn(prev, cur map[string]bool) map[string]bool {
+	listed := make(map[string]bool)
+	for prefix := range cur {
+		if prev[prefix] {
+			listed[prefix] = true
+			continue
+		}
+		if err := s.WithdrawPrefix(prefix); err != nil {
+			log.Warnf("failed to withdraw %s: %s", prefix, err)
+			continue
+		}
+		listed[prefix] = true
+	}
+	for prefix := range prev {
+		if cur[prefix] {
+			continue
+		}
+		if err := s.ReAdvertise(prefix); err != nil {
+			log.Warnf("failed to re-advertise %s: %s", prefix, err)
+			listed[prefix] = true
+		}
+	}
+	return listed
+}
+
+// readPrefixFile returns the prefixes listed in the file at 'path', one per
+// line. A missing file lists no prefix.
+func readPrefixFile(path string) (map[string]bool, error) {
+	prefixes := make(map[string]bool)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return prefixes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, err
+		}
+		prefixes[ipNet.String()] = true
+	}
+	return prefixes, nil
+}
+
+// deleteNeighbor removes a neighbor which is no longer configured.
+// When SHUTDOWN_MESSAGE is set, the neighbor is told why with the
+// administrative shutdown communication before it is removed.
+// In observe-only mode, it only logs the neighbor.
+func (s *Server) deleteNeighbor(n *bgpconfig.Neighbor) error {
+	if s.observeOnly {
+		s.observe("delete_neighbor", "delete neighbor %s", n.Config.NeighborAddress)
+		return nil
+	}
+	if msg := shutdownMessage(n); msg != "" {
+		addr := n.Config.NeighborAddress
+		if err := s.bgpServer.ShutdownNeighbor(addr, msg); err != nil {
+			log.Warnf("failed to send shutdown communication to %s: %s", addr, err)
+		}
+	}
+	if err := s.retryNeighbor("delete", n, s.bgpServer.DeleteNeighbor); err != nil {
+		return err
+	}
+	return s.updatePrepend(n, true)
+}
+
+// shutdownMessage returns the administrative shutdown communication sent
+// to the neighbor 'n' when it is removed. It is empty when SHUTDOWN_MESSAGE
+// is not set.
+func shutdownMessage(n *bgpconfig.Neighbor) string {
+	tmpl := os.Getenv(SHUTDOWN_MESSAGE)
+	if tmpl == "" {
+		return ""
+	}
+	return strings.NewReplacer("{address}", n.Config.NeighborAddress, "{description}", n.Config.Description).Replace(tmpl)
+}
+
+// supportsRouteRefresh returns true if the route refresh capability has been
+// negotiated with the neighbor
+func supportsRouteRefresh(n *bgpconfig.Neighbor) bool {
+	for _, c := range n.State.RemoteCapabilityList {
+		if c.Code() == bgp.BGP_CAP_ROUTE_REFRESH {
+			return true
+		}
+	}
+	return false
+}
+
+// SoftResetNeighbor re-evaluates the routes exchanged with the neighbor at
+// 'address' in the given direction without bouncing the session.
+// Refreshing received routes requires the peer to support route refresh;
+// when it doesn't, the neighbor is deleted and added again.
+// In observe-only mode, it only logs the neighbor.
+func (s *Server) SoftResetNeighbor(address string, direction bgptable.PolicyDirection) error {
+	address = normalizeAddress(address)
+	if s.observeOnly {
+		s.observe("soft_reset_neighbor", "soft reset neighbor %s", address)
+		return nil
+	}
+	ns := s.bgpServer.GetNeighbor(address, false)
+	if len(ns) == 0 {
+		return fmt.Errorf("neighbor %s not found", address)
+	}
+	n := ns[0]
+	if direction != bgptable.POLICY_DIRECTION_EXPORT && !supportsRouteRefresh(n) {
+		log.Printf("neighbor %s doesn't support route refresh. re-adding", address)
+		return s.replaceNeighbor(n, n)
+	}
+	// family 0 resets all the families configured on the neighbor
+	switch direction {
+	case bgptable.POLICY_DIRECTION_IMPORT:
+		return s.bgpServer.SoftResetIn(address, bgp.RouteFamily(0))
+	case bgptable.POLICY_DIRECTION_EXPORT:
+		return s.bgpServer.SoftResetOut(address, bgp.RouteFamily(0))
+	}
+	return s.bgpServer.SoftReset(address, bgp.RouteFamily(0))
+}
+
+// AdvertisedPaths returns the paths this daemon originates, e.g. the blocks
+// assigned to the node and kernel routes, as they are in the global RIB.
+// Withdrawn paths are not included.
+func (s *Server) AdvertisedPaths() ([]*bgptable.Path, error) {
+	var paths []*bgptable.Path
+	for _, family := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+		tbl, err := s.bgpServer.GetRib("", family, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, dst := range tbl.GetDestinations() {
+			for _, path := range dst.GetAllKnownPathList() {
+				if path.IsLocal() {
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	return paths, nil
+}
+
+// waitEstablished blocks until a session with any neighbor is established
+// or 'timeout' passes, and reports whether a session was established.
+func (s *Server) waitEstablished(timeout time.Duration) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		for _, n := range s.getNeighbors("") {
+			if n.State.SessionState == bgpconfig.SESSION_STATE_ESTABLISHED {
+				return true
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return false
+		case <-s.t.Dying():
+			return false
+		}
+	}
+}
+
+// logPrefixCounts reports the number of prefixes received from and
+// advertised to each BGP neighbor every 'interval'.
+func (s *Server) logPrefixCounts(interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.t.Dying():
+			return nil
+		}
+		reportPrefixCounts(s.bgpServer.GetNeighbor("", true))
+	}
+}
+
+// reportPrefixCounts logs the prefix counts of the neighbors 'ns' and
+// replaces prefixCountsMetric with them, so that the neighbors deleted
+// since the last report are dropped
+func reportPrefixCounts(ns []*bgpconfig.Neighbor) {
+	prefixCountsMetric.Init()
+	for _, n := range ns {
+		adj := n.State.AdjTable
+		log.WithFields(log.Fields{
+			"neighbor":   n.Config.NeighborAddress,
+			"received":   adj.Received,
+			"accepted":   adj.Accepted,
+			"advertised": adj.Advertised,
+		}).Info("prefix counts")
+		counts := new(expvar.Map).Init()
+		for name, v := range map[string]uint32{
+			"received":   adj.Received,
+			"accepted":   adj.Accepted,
+			"advertised": adj.Advertised,
+		} {
+			i := new(expvar.Int)
+			i.Set(int64(v))
+			counts.Set(name, i)
+		}
+		prefixCountsMetric.Set(n.Config.NeighborAddress, counts)
+	}
+}
+
+// serveMetrics serves the metrics published by expvar at 'addr' until the
+// daemon stops
+func (s *Server) serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to serve metrics: %s", err)
+	}
+	go func() {
+		<-s.t.Dying()
+		l.Close()
+	}()
+	log.Printf("serving metrics at http://%s/debug/vars", l.Addr())
+	err = http.Serve(l, nil)
+	select {
+	case <-s.t.Dying():
+		return nil
+	default:
+		return fmt.Errorf("failed to serve metrics: %s", err)
+	}
+}
+
+// neighborQuarantine tracks the consecutive failures of the neighbors to
+// establish, and the time until which the quarantined ones stay disabled
+type neighborQuarantine struct {
+	threshold int
+	duration  time.Duration
+	failures  map[string]int
+	until     map[string]time.Time
+}
+
+func newNeighborQuarantine(threshold int, duration time.Duration) *neighborQuarantine {
+	return &neighborQuarantine{
+		threshold: threshold,
+		duration:  duration,
+		failures:  make(map[string]int),
+		until:     make(map[string]time.Time),
+	}
+}
+
+// check records the state of the neighbors 'ns' at 'now'. The neighbors
+// which reached the threshold are disabled with 'disable', and the ones
+// whose quarantine is over are enabled again with 'enable'.
+func (q *neighborQuarantine) check(now time.Time, ns []*bgpconfig.Neighbor, disable, enable func(addr string) error) {
+	seen := make(map[string]bool)
+	for _, n := range ns {
+		addr := n.Config.NeighborAddress
+		seen[addr] = true
+		if until, ok := q.until[addr]; ok {
+			if now.Before(until) {
+				continue
+			}
+			log.Printf("releasing neighbor %s from quarantine", addr)
+			if err := enable(addr); err != nil {
+				log.Warnf("failed to enable neighbor %s: %s", addr, err)
+				continue
+			}
+			delete(q.until, addr)
+			q.failures[addr] = 0
+			continue
+		}
+		if n.State.SessionState == bgpconfig.SESSION_STATE_ESTABLISHED {
+			q.failures[addr] = 0
+			continue
+		}
+		q.failures[addr]++
+		if q.failures[addr] < q.threshold {
+			continue
+		}
+		log.Errorf("neighbor %s failed to establish %d times in a row. quarantining it for %s", addr, q.failures[addr], q.duration)
+		if err := disable(addr); err != nil {
+			log.Warnf("failed to disable neighbor %s: %s", addr, err)
+			continue
+		}
+		q.until[addr] = now.Add(q.duration)
+	}
+	// forget the neighbors which have been deleted
+	for addr := range q.failures {
+		if !seen[addr] {
+			delete(q.failures, addr)
+			delete(q.until, addr)
+		}
+	}
+	neighborsQuarantinedMetric.Set(int64(len(q.until)))
+}
+
+// quarantineNeighbors disables the neighbors which are not established in
+// 'threshold' consecutive checks, and enables them again after 'duration'
+// so that they are retried at a slower cadence than the connect retry.
+func (s *Server) quarantineNeighbors(threshold int, duration time.Duration) error {
+	q := newNeighborQuarantine(threshold, duration)
+	disable := func(addr string) error {
+		return s.bgpServer.DisableNeighbor(addr, "quarantined")
+	}
+	ticker := time.NewTicker(quarantineCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.t.Dying():
+			return nil
+		}
+		q.check(time.Now(), s.getNeighbors(""), disable, s.bgpServer.EnableNeighbor)
+	}
+}
+
+// missingNeighbors returns the neighbors of 'desired' which are in
+// 'current' neither by address nor by description
+func missingNeighbors(current, desired []*bgpconfig.Neighbor) []*bgpconfig.Neighbor {
+	addrs := make(map[string]bool)
+	descs := make(map[string]bool)
+	for _, n := range current {
+		addrs[n.Config.NeighborAddress] = true
+		descs[n.Config.Description] = true
+	}
+	var ret []*bgpconfig.Neighbor
+	for _, n := range desired {
+		if addrs[n.Config.NeighborAddress] || (n.Config.Description != "" && descs[n.Config.Description]) {
+			continue
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+// reconcileNeighbors re-adds the configured neighbors which are missing
+// from the BGP server every 'interval'. The neighbors are listed before
+// the configuration is read, so that a neighbor deleted meanwhile isn't
+// added back. A missing neighbor whose description is in use has moved to
+// another address, which the watchers take care of.
+func (s *Server) reconcileNeighbors(interval time.Duration) error {
+	errs, err := newErrorLimiter()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.t.Dying():
+			return nil
+		}
+		if s.inMaintenance() {
+			continue
+		}
+		current := s.bgpServer.GetNeighbor("", false)
+		ns, err := s.getNeighborConfigs()
+		if err != nil {
+			errs.log(log.Warnf, fmt.Sprintf("failed to get neighbor configuration to reconcile: %s", err))
+			continue
+		}
+		errs.reset("got neighbor configuration to reconcile again")
+		for _, n := range missingNeighbors(current, ns) {
+			log.Warnf("neighbor %s is missing from the BGP server. re-adding it", n.Config.NeighborAddress)
+			if err := s.addNeighbor(n); err != nil {
+				log.Errorf("failed to re-add neighbor %s: %s", n.Config.NeighborAddress, err)
+			}
+		}
+	}
+}
+
+// inMaintenance returns true while the file at MAINTENANCE_FILE exists
+func (s *Server) inMaintenance() bool {
+	path := os.Getenv(MAINTENANCE_FILE)
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// waitMaintenance blocks the watcher 'name' while in maintenance mode, or
+// until the daemon stops
+func (s *Server) waitMaintenance(name string) {
+	if !s.inMaintenance() {
+		return
+	}
+	log.Warnf("maintenance mode: holding back %s changes until %s is removed", name, os.Getenv(MAINTENANCE_FILE))
+	ticker := time.NewTicker(s.maintenanceWait)
+	defer ticker.Stop()
+	for s.inMaintenance() {
+		select {
+		case <-ticker.C:
+		case <-s.t.Dying():
+			return
+		}
+	}
+	log.Printf("maintenance mode cleared: applying %s changes", name)
+}
+
+// watchDrainSignal drains the advertised prefixes when SIGUSR2 is received
+// and returns an error so that the daemon exits
+func (s *Server) watchDrainSignal(prepend uint8, settle time.Duration) error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	defer signal.Stop(ch)
+	select {
+	case <-ch:
+	case <-s.t.Dying():
+		return nil
+	}
+	if err := s.drain(prepend, settle); err != nil {
+		return fmt.Errorf("failed to drain: %s", err)
+	}
+	return fmt.Errorf("drained")
+}
+
+// getDrainPrepend returns the number of times the local AS is prepended
+// while draining. It must fit the AS-path prepend count of gobgp.
+func getDrainPrepend() (uint8, error) {
+	prepend, err := getIntFromEnv(DRAIN_PREPEND, defaultDrainPrepend)
+	if err != nil {
+		return 0, err
+	}
+	if prepend < 0 || prepend > math.MaxUint8 {
+		return 0, fmt.Errorf("invalid %s: %d is out of the range 0-%d", DRAIN_PREPEND, prepend, math.MaxUint8)
+	}
+	return uint8(prepend), nil
+}
+
+// drain makes the peers shift traffic away from this node before its
+// prefixes are withdrawn. The prefixes are re-advertised less preferred,
+// and withdrawn after 'settle'.
+func (s *Server) drain(prepend uint8, settle time.Duration) error {
+	asn, err := s.getNodeASN()
+	if err != nil {
+		return err
+	}
+	return s.drainPaths(uint32(asn), prepend, settle)
+}
+
+// drainPaths re-advertises the paths originated in the global RIB and in
+// the VRF with the GRACEFUL_SHUTDOWN community and 'asn' prepended
+// 'prepend' times, and withdraws them after 'settle'
+func (s *Server) drainPaths(asn uint32, prepend uint8, settle time.Duration) error {
+	global, err := s.AdvertisedPaths()
+	if err != nil {
+		return err
+	}
+	vrf, err := s.vrfPaths()
+	if err != nil {
+		return err
+	}
+	drain := func(paths []*bgptable.Path) (drained, withdrawn []*bgptable.Path) {
+		for _, path := range paths {
+			p := path.Clone(false)
+			p.SetCommunities([]uint32{gracefulShutdownComm}, false)
+			if prepend > 0 {
+				p.PrependAsn(asn, prepend, false)
+			}
+			drained = append(drained, p)
+			withdrawn = append(withdrawn, path.Clone(true))
+		}
+		return drained, withdrawn
+	}
+	globalDrained, globalWithdrawn := drain(global)
+	vrfDrained, vrfWithdrawn := drain(vrf)
+	log.Printf("draining %d prefix(es). withdrawing them in %s", len(global)+len(vrf), settle)
+	if err = s.addPath("", globalDrained); err != nil {
+		return err
+	}
+	if err = s.addPath(s.vrf, vrfDrained); err != nil {
+		return err
+	}
+	select {
+	case <-time.After(settle):
+	case <-s.t.Dying():
+	}
+	if err = s.addPath("", globalWithdrawn); err != nil {
+		return err
+	}
+	return s.addPath(s.vrf, vrfWithdrawn)
+}
+
+// vrfPaths returns the paths this daemon originates in s.vrf. The VRF RIB
+// holds them as VPN paths, so they are made again from the prefixes addPath
+// advertised there.
+func (s *Server) vrfPaths() ([]*bgptable.Path, error) {
+	if s.vrf == "" {
+		return nil, nil
+	}
+	var prefixes []string
+	s.pathIDMu.Lock()
+	for key := range s.pathIDs {
+		if key.vrf == s.vrf {
+			prefixes = append(prefixes, key.prefix)
+		}
+	}
+	s.pathIDMu.Unlock()
+	paths := make([]*bgptable.Path, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		path, err := s.makePath(prefix, false)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// neighborStatus is the status of a BGP neighbor in the status file
+type neighborStatus struct {
+	Address     string `json:"address"`
+	ASN         uint32 `json:"as_num"`
+	Description string `json:"description"`
+	State       string `json:"state"`
+}
+
+// status is the content of the status file
+type status struct {
+	Neighbors   []neighborStatus     `json:"neighbors"`
+	Advertised  []string             `json:"advertised"`
+	Pools       int                  `json:"pools"`
+	LastSynced  map[string]time.Time `json:"last_synced"`
+	Stale       []string             `json:"stale"`
+	Maintenance bool                 `json:"maintenance"`
+	Observed    map[string]int       `json:"observed,omitempty"`
+}
+
+// writeStatusFile writes the status to the file at 'path' every 'interval'.
+// The subsystems not synchronized within 'staleAfter' are reported stale,
+// unless it is zero.
+func (s *Server) writeStatusFile(path string, interval, staleAfter time.Duration) error {
+	errs, err := newErrorLimiter()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.writeStatus(path, staleAfter); err != nil {
+			errs.log(log.Warnf, fmt.Sprintf("failed to write status file %s: %s", path, err))
+		} else {
+			errs.reset(fmt.Sprintf("wrote status file %s again", path))
+		}
+		select {
+		case <-ticker.C:
+		case <-s.t.Dying():
+			return nil
+		}
+	}
+}
+
+// writeStatus writes the status to a temporary file and renames it to
+// 'path', so that readers never see a partially written file
+func (s *Server) writeStatus(path string, staleAfter time.Duration) error {
+	st := status{
+		Neighbors:   []neighborStatus{},
+		Advertised:  []string{},
+		LastSynced:  s.status.snapshot(),
+		Stale:       []string{},
+		Maintenance: s.inMaintenance(),
+	}
+	if s.observeOnly {
+		st.Observed = s.observedCounts()
+	}
+	if staleAfter > 0 {
+		st.Stale = append(st.Stale, s.status.stale(syncSubsystems, staleAfter)...)
+	}
+	for _, n := range s.getNeighbors("") {
+		st.Neighbors = append(st.Neighbors, neighborStatus{
+			Address:     n.Config.NeighborAddress,
+			ASN:         n.Config.PeerAs,
+			Description: n.Config.Description,
+			State:       string(n.State.SessionState),
+		})
+	}
+	paths, err := s.AdvertisedPaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		st.Advertised = append(st.Advertised, path.GetNlri().String())
+	}
+	if s.ipam != nil {
+		st.Pools = len(s.ipam.pools())
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stateDump is the content of the dump file. The RIBs are keyed by the
+// address family, and the Adj-RIBs by the neighbor address first.
+type stateDump struct {
+	Time      time.Time                              `json:"time"`
+	Neighbors []*bgpconfig.Neighbor                  `json:"neighbors"`
+	Global    map[string][]*bgptable.Path            `json:"global"`
+	AdjIn     map[string]map[string][]*bgptable.Path `json:"adj_in"`
+	AdjOut    map[string]map[string][]*bgptable.Path `json:"adj_out"`
+}
+
+// dumpState writes the neighbor table and the RIBs of the BGP server to a
+// temporary file and renames it to 'path'. The BGP server serializes the
+// queries with its own updates, so it is safe while the daemon runs.
+// Passwords are redacted.
+func (s *Server) dumpState(path string) error {
+	d := stateDump{
+		Time:   time.Now(),
+		Global: make(map[string][]*bgptable.Path),
+		AdjIn:  make(map[string]map[string][]*bgptable.Path),
+		AdjOut: make(map[string]map[string][]*bgptable.Path),
+	}
+	tablePaths := func(tbl *bgptable.Table) []*bgptable.Path {
+		paths := []*bgptable.Path{}
+		for _, dst := range tbl.GetDestinations() {
+			paths = append(paths, dst.GetAllKnownPathList()...)
+		}
+		return paths
+	}
+	families := map[bgp.RouteFamily]bool{bgp.RF_IPv4_UC: true, bgp.RF_IPv6_UC: true}
+	for _, n := range s.bgpServer.GetNeighbor("", false) {
+		if n.Config.AuthPassword != "" {
+			n.Config.AuthPassword = "<redacted>"
+		}
+		d.Neighbors = append(d.Neighbors, n)
+		addr := n.Config.NeighborAddress
+		d.AdjIn[addr] = make(map[string][]*bgptable.Path)
+		d.AdjOut[addr] = make(map[string][]*bgptable.Path)
+		for _, a := range n.AfiSafis {
+			family, err := bgp.GetRouteFamily(string(a.Config.AfiSafiName))
+			if err != nil {
+				continue
 			}
-			host := elems[len(elems)-2]
-			switch elems[len(elems)-1] {
-			case "ip_addr_v4", "ip_addr_v6":
-				switch res.Action {
-				case "delete":
-					if err = deleteNeighbor(res.PrevNode); err != nil {
-						return err
-					}
-				case "set":
-					if res.PrevNode != nil {
-						if err = deleteNeighbor(res.PrevNode); err != nil {
-							return err
-						}
-					}
-					if res.Node.Value == "" {
-						continue
-					}
-					asn, err := s.getPeerASN(host)
-					if err != nil {
-						return err
-					}
-					n := &bgpconfig.Neighbor{
-						Config: bgpconfig.NeighborConfig{
-							NeighborAddress: res.Node.Value,
-							PeerAs:          uint32(asn),
-							Description:     fmt.Sprintf("Mesh_%s", underscore(res.Node.Value)),
-						},
-					}
-					if err = s.bgpServer.AddNeighbor(n); err != nil {
-						return err
-					}
+			families[family] = true
+			for _, in := range []bool{true, false} {
+				tbl, err := s.bgpServer.GetAdjRib(addr, family, in, nil)
+				if err != nil {
+					return err
 				}
-			case "as_num":
-				var asn numorstring.ASNumber
-				if res.Action == "set" {
-					asn, err = numorstring.ASNumberFromString(res.Node.Value)
-					if err != nil {
-						return err
-					}
+				if in {
+					d.AdjIn[addr][family.String()] = tablePaths(tbl)
 				} else {
-					asn, err = s.getNodeASN()
-					if err != nil {
-						return err
-					}
-				}
-				for _, version := range []string{"v4", "v6"} {
-					res, err := s.etcd.Get(context.Background(), fmt.Sprintf("%s/host/%s/ip_addr_%s", CALICO_BGP, host, version), nil)
-					if errorButKeyNotFound(err) != nil {
-						return err
-					}
-					if res == nil {
-						continue
-					}
-					if err = deleteNeighbor(res.Node); err != nil {
-						return err
-					}
-					ip := res.Node.Value
-					n := &bgpconfig.Neighbor{
-						Config: bgpconfig.NeighborConfig{
-							NeighborAddress: ip,
-							PeerAs:          uint32(asn),
-							Description:     fmt.Sprintf("Mesh_%s", underscore(ip)),
-						},
-					}
-					if err = s.bgpServer.AddNeighbor(n); err != nil {
-						return err
-					}
+					d.AdjOut[addr][family.String()] = tablePaths(tbl)
 				}
-			default:
-				log.Printf("unhandled key: %s", key)
-			}
-		case strings.HasPrefix(key, fmt.Sprintf("%s/global/as_num", CALICO_BGP)):
-			log.Println("Global AS number update. Restart")
-			os.Exit(1)
-		case strings.HasPrefix(key, fmt.Sprintf("%s/global/node_mesh", CALICO_BGP)):
-			mesh, err := s.isMeshMode()
-			if err != nil {
-				return err
 			}
-			ns, err := s.getMeshNeighborConfigs()
-			if err != nil {
-				return err
+		}
+	}
+	for family := range families {
+		tbl, err := s.bgpServer.GetRib("", family, nil)
+		if err != nil {
+			return err
+		}
+		d.Global[family.String()] = tablePaths(tbl)
+	}
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// watchDumpSignal calls dumpConfig, and dumpState when DUMP_FILE is set,
+// every time SIGUSR1 is received
+func (s *Server) watchDumpSignal() error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ch:
+			if err := s.dumpConfig(); err != nil {
+				log.Printf("failed to dump config: %s", err)
 			}
-			for _, n := range ns {
-				if mesh {
-					err = s.bgpServer.AddNeighbor(n)
+			if path := os.Getenv(DUMP_FILE); path != "" {
+				if err := s.dumpState(path); err != nil {
+					log.Printf("failed to dump state to %s: %s", path, err)
 				} else {
-					err = s.bgpServer.DeleteNeighbor(n)
-				}
-				if err != nil {
-					return err
+					log.Printf("dumped state to %s", path)
 				}
 			}
+		case <-s.t.Dying():
+			return nil
+		}
+	}
+}
+
+// dumpConfig logs the BGP neighbors and IP pools which the daemon derived
+// from etcd. Passwords are redacted.
+func (s *Server) dumpConfig() error {
+	ns, err := s.getNeighborConfigs()
+	if err != nil {
+		return err
+	}
+	return s.logConfig(ns)
+}
+
+// logConfig logs the neighbors 'ns', and the IP pools and the paths which
+// the daemon derived from etcd
+func (s *Server) logConfig(ns []*bgpconfig.Neighbor) error {
+	for _, n := range ns {
+		c := n.Config
+		if c.AuthPassword != "" {
+			c.AuthPassword = "<redacted>"
 		}
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		log.Printf("dump: neighbor: %s", b)
+	}
+	for _, p := range s.ipam.pools() {
+		b, err := json.Marshal(p)
 		if err != nil {
 			return err
 		}
+		log.Printf("dump: ip pool: %s", b)
 	}
+	paths, err := s.AdvertisedPaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		log.Printf("dump: advertised path: %s", path)
+	}
+	return nil
 }
 
 // watchKernelRoute receives netlink route update notification and announces
@@ -814,11 +4695,15 @@ func (s *Server) watchKernelRoute() error {
 				continue
 			}
 			path, err := s.makePath(update.Dst.String(), isWithdrawal)
+			if _, ok := err.(*noNexthopError); ok {
+				log.Printf("ignore kernel route: %s", err)
+				continue
+			}
 			if err != nil {
 				return err
 			}
 			log.Printf("made path from kernel update: %s", path)
-			if _, err = s.bgpServer.AddPath("", []*bgptable.Path{path}); err != nil {
+			if err = s.addPath("", []*bgptable.Path{path}); err != nil {
 				return err
 			}
 		} else if update.Table == syscall.RT_TABLE_LOCAL {
@@ -843,6 +4728,10 @@ func (s *Server) watchKernelRoute() error {
 // injectRoute is a helper function to inject BGP routes to linux kernel
 // TODO: multipath support
 func (s *Server) injectRoute(path *bgptable.Path) error {
+	if s.observeOnly {
+		s.observe("inject_route", "inject route %s", path.GetNlri())
+		return nil
+	}
 	nexthop := path.GetNexthop()
 	nlri := path.GetNlri()
 	dst, _ := netlink.ParseIPNet(nlri.String())
@@ -855,16 +4744,12 @@ func (s *Server) injectRoute(path *bgptable.Path) error {
 	ipip := false
 	if dst.IP.To4() != nil {
 		if p := s.ipam.match(nlri.String()); p != nil {
-			ipip = p.IPIP != ""
-
 			node, err := s.client.Nodes().Get(calicoapi.NodeMetadata{Name: os.Getenv(NODENAME)})
 			if err != nil {
 				return err
 			}
 
-			if p.Mode == "cross-subnet" && !isCrossSubnet(route.Gw, node.Spec.BGP.IPv4Address.Network().IPNet) {
-				ipip = false
-			}
+			ipip = needsIPIP(p, route.Gw, node.Spec.BGP.IPv4Address.Network().IPNet)
 			if ipip {
 				i, err := net.InterfaceByName(p.IPIP)
 				if err != nil {
@@ -896,6 +4781,11 @@ func (s *Server) injectRoute(path *bgptable.Path) error {
 // TODO: multipath support
 func (s *Server) watchBGPPath() error {
 	watcher := s.bgpServer.Watch(bgpserver.WatchBestPath(false))
+	// the paths are queued until the pools, which decide the encapsulation
+	// of the routes, have been loaded
+	if !s.ipam.waitReady(s.t.Dying()) {
+		return nil
+	}
 	for {
 		var paths []*bgptable.Path
 		select {
@@ -930,14 +4820,57 @@ func (s *Server) initialPolicySetting() error {
 		}
 		return s.bgpServer.AddDefinedSet(ps)
 	}
-	for _, name := range []string{aggregatedPrefixSetName, hostPrefixSetName} {
+	for _, name := range []string{aggregatedPrefixSetName, hostPrefixSetName, poolPrefixSetName, originatedPrefixSetName} {
 		if err := createEmptyPrefixSet(name); err != nil {
 			return err
 		}
 	}
-	// intended to work as same as 'calico_pools' export filter of BIRD configuration
+	if list, err := parsePrefixList(os.Getenv(EXPORT_PREFIXES)); err != nil {
+		return fmt.Errorf("invalid %s: %s", EXPORT_PREFIXES, err)
+	} else if len(list) > 0 {
+		ps, err := bgptable.NewPrefixSet(bgpconfig.PrefixSet{
+			PrefixSetName: aggregatedPrefixSetName,
+			PrefixList:    list,
+		})
+		if err != nil {
+			return err
+		}
+		if err = s.bgpServer.AddDefinedSet(ps); err != nil {
+			return err
+		}
+	}
+	definition := aggrPolicy(s.exportPoolsOnly)
+	policy, err := bgptable.NewPolicy(definition)
+	if err != nil {
+		return err
+	}
+	if err = s.bgpServer.AddPolicy(policy, false); err != nil {
+		return err
+	}
+	policies := []*bgpconfig.PolicyDefinition{&definition}
+	if !s.exportLearned {
+		originated := originatedPolicy()
+		policy, err := bgptable.NewPolicy(originated)
+		if err != nil {
+			return err
+		}
+		if err = s.bgpServer.AddPolicy(policy, false); err != nil {
+			return err
+		}
+		policies = []*bgpconfig.PolicyDefinition{&originated, &definition}
+	}
+	return s.bgpServer.AddPolicyAssignment("", bgptable.POLICY_DIRECTION_EXPORT,
+		policies,
+		bgptable.ROUTE_TYPE_ACCEPT)
+}
+
+// aggrPolicy accepts the routes in the 'aggregated' prefix-set and rejects
+// the ones in the 'host' prefix-set. With 'poolsOnly', the routes outside
+// the 'pool' prefix-set are rejected before them.
+// intended to work as same as 'calico_pools' export filter of BIRD configuration
+func aggrPolicy(poolsOnly bool) bgpconfig.PolicyDefinition {
 	definition := bgpconfig.PolicyDefinition{
-		Name: "calico_aggr",
+		Name: aggrPolicyName,
 		Statements: []bgpconfig.Statement{
 			bgpconfig.Statement{
 				Conditions: bgpconfig.Conditions{
@@ -961,28 +4894,210 @@ func (s *Server) initialPolicySetting() error {
 			},
 		},
 	}
-	policy, err := bgptable.NewPolicy(definition)
+	if poolsOnly {
+		// reject anything outside the pools before the statements above
+		definition.Statements = append([]bgpconfig.Statement{
+			bgpconfig.Statement{
+				Conditions: bgpconfig.Conditions{
+					MatchPrefixSet: bgpconfig.MatchPrefixSet{
+						PrefixSet:       poolPrefixSetName,
+						MatchSetOptions: bgpconfig.MATCH_SET_OPTIONS_RESTRICTED_TYPE_INVERT,
+					},
+				},
+				Actions: bgpconfig.Actions{
+					RouteDisposition: bgpconfig.ROUTE_DISPOSITION_REJECT_ROUTE,
+				},
+			},
+		}, definition.Statements...)
+	}
+	return definition
+}
+
+// originatedPolicy rejects the routes whose prefix isn't in the
+// 'originated' prefix-set, which addPath keeps up to date with the routes
+// this node advertises. The origin of a route, unlike the length of its AS
+// path, tells the routes learned from iBGP and confederation peers apart.
+// This is a policy of its own so that it's evaluated before 'calico_aggr'.
+func originatedPolicy() bgpconfig.PolicyDefinition {
+	return bgpconfig.PolicyDefinition{
+		Name: originatedPolicyName,
+		Statements: []bgpconfig.Statement{
+			bgpconfig.Statement{
+				Conditions: bgpconfig.Conditions{
+					MatchPrefixSet: bgpconfig.MatchPrefixSet{
+						PrefixSet:       originatedPrefixSetName,
+						MatchSetOptions: bgpconfig.MATCH_SET_OPTIONS_RESTRICTED_TYPE_INVERT,
+					},
+				},
+				Actions: bgpconfig.Actions{
+					RouteDisposition: bgpconfig.ROUTE_DISPOSITION_REJECT_ROUTE,
+				},
+			},
+		},
+	}
+}
+
+// parsePrefixList parses a comma separated list of prefix-set entries, each
+// of which is a prefix optionally followed by a mask length range
+func parsePrefixList(v string) ([]bgpconfig.Prefix, error) {
+	var list []bgpconfig.Prefix
+	for _, entry := range strings.Split(v, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid prefix-set entry %q", entry)
+		}
+		_, ipNet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		p := bgpconfig.Prefix{IpPrefix: ipNet.String()}
+		if len(fields) == 2 {
+			var min, max int
+			if _, err := fmt.Sscanf(fields[1], "%d..%d", &min, &max); err != nil {
+				return nil, fmt.Errorf("invalid mask length range %q", fields[1])
+			}
+			ones, bits := ipNet.Mask.Size()
+			if min < ones || max < min || max > bits {
+				return nil, fmt.Errorf("invalid mask length range %q for %s", fields[1], ipNet)
+			}
+			p.MasklengthRange = fmt.Sprintf("%d..%d", min, max)
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// poolPrefixes returns the entries of the 'pool' prefix-set, which match
+// the prefixes within the enabled pools of 'pools'
+func poolPrefixes(pools []ipPool) ([]bgpconfig.Prefix, error) {
+	list := make([]bgpconfig.Prefix, 0)
+	for _, p := range pools {
+		if p.Disabled {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(p.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		min, _ := ipNet.Mask.Size()
+		max := 32
+		if ipNet.IP.To4() == nil {
+			max = 128
+		}
+		list = append(list, bgpconfig.Prefix{
+			IpPrefix:        ipNet.String(),
+			MasklengthRange: fmt.Sprintf("%d..%d", min, max),
+		})
+	}
+	return list, nil
+}
+
+// updatePoolPrefixSet replaces the 'pool' prefix-set with the prefixes
+// within the enabled IP pools, and re-evaluates the routes advertised to
+// the neighbors with it
+func (s *Server) updatePoolPrefixSet() error {
+	list, err := poolPrefixes(s.ipam.pools())
 	if err != nil {
 		return err
 	}
-	if err = s.bgpServer.AddPolicy(policy, false); err != nil {
+	ps, err := bgptable.NewPrefixSet(bgpconfig.PrefixSet{
+		PrefixSetName: poolPrefixSetName,
+		PrefixList:    list,
+	})
+	if err != nil {
 		return err
 	}
-	return s.bgpServer.AddPolicyAssignment("", bgptable.POLICY_DIRECTION_EXPORT,
-		[]*bgpconfig.PolicyDefinition{&definition},
-		bgptable.ROUTE_TYPE_ACCEPT)
+	if err = s.bgpServer.ReplaceDefinedSet(ps); err != nil {
+		return err
+	}
+	return s.refreshAdvertisements()
+}
+
+// refreshAdvertisements re-evaluates the export policy for each established
+// neighbor so that a policy change is propagated right away. A failure
+// doesn't prevent the other neighbors from being refreshed.
+func (s *Server) refreshAdvertisements() error {
+	var errs []string
+	for _, n := range s.getNeighbors("") {
+		if n.State.SessionState != bgpconfig.SESSION_STATE_ESTABLISHED {
+			continue
+		}
+		addr := n.Config.NeighborAddress
+		log.Printf("refresh routes advertised to %s", addr)
+		if err := s.SoftResetNeighbor(addr, bgptable.POLICY_DIRECTION_EXPORT); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to refresh %d neighbor(s): %s", len(errs), strings.Join(errs, ", "))
+	}
+	return nil
 }
 
+// updatePrefixSet updates the prefix-sets of the export policy for the
+// assigned prefixes 'paths'. The routes within the prefixes become rejected
+// or accepted, so when there are any, the routes advertised to the
+// neighbors are refreshed.
 func (s *Server) updatePrefixSet(paths []*bgptable.Path) error {
+	prefixes := make([]string, 0, len(paths))
 	for _, path := range paths {
-		err := s._updatePrefixSet(path.GetNlri().String(), path.IsWithdraw)
-		if err != nil {
+		prefix := path.GetNlri().String()
+		if err := s._updatePrefixSet(prefix, path.IsWithdraw); err != nil {
 			return err
 		}
+		prefixes = append(prefixes, prefix)
+	}
+	// the prefixes are in place; a neighbor failing to refresh is left
+	// with stale routes rather than stopping the watcher
+	within, err := s.hasRoutesWithin(prefixes)
+	if err != nil {
+		log.Warnf("failed to look up the routes within %s: %s", strings.Join(prefixes, ", "), err)
+		return nil
+	}
+	if !within {
+		return nil
+	}
+	if err = s.refreshAdvertisements(); err != nil {
+		log.Warn(err)
 	}
 	return nil
 }
 
+// hasRoutesWithin returns true if the global RIB has a route of a longer
+// prefix within any of 'prefixes'. Only those routes are exported
+// differently when the prefixes are assigned or released; a block and its
+// own route are not.
+func (s *Server) hasRoutesWithin(prefixes []string) (bool, error) {
+	for _, prefix := range prefixes {
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return false, err
+		}
+		family := bgp.RF_IPv4_UC
+		if ipNet.IP.To4() == nil {
+			family = bgp.RF_IPv6_UC
+		}
+		tbl, err := s.bgpServer.GetRib("", family, []*bgptable.LookupPrefix{
+			&bgptable.LookupPrefix{
+				Prefix:       ipNet.String(),
+				LookupOption: bgptable.LOOKUP_LONGER,
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+		for _, dst := range tbl.GetDestinations() {
+			if dst.GetNlri().String() != ipNet.String() {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 // _updatePrefixSet updates 'aggregated' and 'host' prefix-sets
 // we add the exact prefix to 'aggregated' set, and add corresponding longer
 // prefixes to 'host' set.
@@ -1038,6 +5153,101 @@ func (s *Server) _updatePrefixSet(prefix string, del bool) error {
 	return s.bgpServer.AddDefinedSet(ps)
 }
 
+// loadConfigFile sets the environment variables in the config file at
+// 'path' which are not set yet. Values may be strings, numbers or booleans.
+func loadConfigFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err = json.Unmarshal(b, &config); err != nil {
+		if e, ok := err.(*json.SyntaxError); ok {
+			line := 1 + strings.Count(string(b[:e.Offset]), "\n")
+			return fmt.Errorf("invalid config file %s: line %d: %s", path, line, err)
+		}
+		return fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	for name, value := range config {
+		var v string
+		switch value := value.(type) {
+		case string:
+			v = value
+		case float64:
+			v = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			v = strconv.FormatBool(value)
+		default:
+			return fmt.Errorf("invalid config file %s: %s must be a string, a number or a boolean", path, name)
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		if err = os.Setenv(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selfTest prints the path makePath makes for 'prefix' with 'nexthop' and
+// adds it to the prefix-sets of a BGP server which doesn't listen, so that
+// the encoding can be checked without etcd or peers
+func selfTest(prefix, nexthop string) error {
+	origin, err := parseOrigin(os.Getenv(ORIGIN))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", ORIGIN, err)
+	}
+	med, medOverrides, err := getMEDConfig()
+	if err != nil {
+		return err
+	}
+	s := &Server{
+		bgpServer:    bgpserver.NewBgpServer(),
+		ipv4:         net.ParseIP("192.0.2.1"),
+		ipv6:         net.ParseIP("2001:db8::1"),
+		origin:       origin,
+		med:          med,
+		medOverrides: medOverrides,
+	}
+	if nexthop != "" {
+		ip := net.ParseIP(nexthop)
+		if ip == nil {
+			return fmt.Errorf("invalid next hop %q", nexthop)
+		}
+		if ip.To4() != nil {
+			s.ipv4 = ip
+		} else {
+			s.ipv6 = ip
+		}
+	}
+	path, err := s.makePath(prefix, false)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("nlri: %s\n", path.GetNlri())
+	fmt.Printf("family: %s\n", path.GetRouteFamily())
+	fmt.Printf("nexthop: %s\n", path.GetNexthop())
+	for _, a := range path.GetPathAttrs() {
+		fmt.Printf("attribute: %s\n", a)
+	}
+
+	go s.bgpServer.Serve()
+	defer s.bgpServer.Stop()
+	// a negative port keeps the server from listening
+	if err = s.startBGP(numorstring.ASNumber(defaultGlobalASN), s.ipv4, -1); err != nil {
+		return err
+	}
+	if err = s.initialPolicySetting(); err != nil {
+		return err
+	}
+	if err = s.updatePrefixSet([]*bgptable.Path{path}); err != nil {
+		return err
+	}
+	fmt.Println("prefix-sets: ok")
+	return nil
+}
+
 func main() {
 
 	// Display the version on "-v", otherwise just delegate to the skel code.
@@ -1045,6 +5255,8 @@ func main() {
 	flagSet := flag.NewFlagSet("Calico", flag.ExitOnError)
 
 	version := flagSet.Bool("v", false, "Display version")
+	selftest := flagSet.String("selftest", "", "Print the BGP path made for the given CIDR and exit")
+	nexthop := flagSet.String("nexthop", "", "Next hop of the path printed by -selftest")
 	err := flagSet.Parse(os.Args[1:])
 	if err != nil {
 		fmt.Println(err)
@@ -1054,6 +5266,20 @@ func main() {
 		fmt.Println(VERSION)
 		os.Exit(0)
 	}
+	if path := os.Getenv(CONFIG_FILE); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *selftest != "" {
+		if err := selfTest(*selftest, *nexthop); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	rawloglevel := os.Getenv("CALICO_BGP_LOGSEVERITYSCREEN")
 	loglevel := log.InfoLevel
@@ -0,0 +1,3168 @@
+// Copyright (C) 2016 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	bgpconfig "github.com/osrg/gobgp/config"
+	bgp "github.com/osrg/gobgp/packet/bgp"
+	bgpserver "github.com/osrg/gobgp/server"
+	bgptable "github.com/osrg/gobgp/table"
+	calicoapi "github.com/projectcalico/libcalico-go/lib/api"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/numorstring"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// newTestServer returns a Server with a running BGP server which doesn't
+// listen, and the export policy set up
+func newTestServer(t *testing.T) *Server {
+	bgpServer := bgpserver.NewBgpServer()
+	go bgpServer.Serve()
+	err := bgpServer.Start(&bgpconfig.Global{
+		Config: bgpconfig.GlobalConfig{
+			As:       64512,
+			RouterId: "10.0.0.1",
+			Port:     -1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		bgpServer: bgpServer,
+		ipv4:      net.ParseIP("10.0.0.1"),
+		ipv6:      net.ParseIP("fd00::1"),
+	}
+	if err = s.initialPolicySetting(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// advertised returns true when 'prefix' is originated in the global RIB
+func advertised(t *testing.T, s *Server, prefix string) bool {
+	paths, err := s.AdvertisedPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if path.GetNlri().String() == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// advertise adds the paths of 'prefixes' to the global RIB like a sync
+func advertise(t *testing.T, s *Server, prefixes ...string) {
+	for _, prefix := range prefixes {
+		path, err := s.makePath(prefix, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.addPath("", []*bgptable.Path{path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testPath returns a path of the IPv4 'prefix' with an AS path segment of
+// 'segType' and 'asns', learned from 'peer' or originated locally when
+// 'peer' is nil
+func testPath(peer *bgptable.PeerInfo, prefix string, segType uint8, asns ...uint32) *bgptable.Path {
+	_, ipNet, _ := net.ParseCIDR(prefix)
+	ones, _ := ipNet.Mask.Size()
+	attrs := []bgp.PathAttributeInterface{
+		bgp.NewPathAttributeOrigin(0),
+		bgp.NewPathAttributeNextHop("10.0.0.1"),
+	}
+	if len(asns) > 0 {
+		attrs = append(attrs, bgp.NewPathAttributeAsPath([]bgp.AsPathParamInterface{
+			bgp.NewAs4PathParam(segType, asns),
+		}))
+	}
+	return bgptable.NewPath(peer, bgp.NewIPAddrPrefix(uint8(ones), ipNet.IP.String()), false, attrs, time.Now(), false)
+}
+
+func TestOriginatedPolicy(t *testing.T) {
+	rp := bgptable.NewRoutingPolicy()
+	err := rp.Reset(&bgpconfig.RoutingPolicy{
+		DefinedSets: bgpconfig.DefinedSets{
+			PrefixSets: []bgpconfig.PrefixSet{
+				bgpconfig.PrefixSet{
+					PrefixSetName: originatedPrefixSetName,
+					PrefixList: []bgpconfig.Prefix{
+						bgpconfig.Prefix{IpPrefix: "192.168.1.0/26"},
+						bgpconfig.Prefix{IpPrefix: "192.168.2.1/32"},
+					},
+				},
+			},
+		},
+		PolicyDefinitions: []bgpconfig.PolicyDefinition{originatedPolicy()},
+	}, map[string]bgpconfig.ApplyPolicy{
+		bgptable.GLOBAL_RIB_NAME: bgpconfig.ApplyPolicy{
+			Config: bgpconfig.ApplyPolicyConfig{
+				ExportPolicyList:    []string{originatedPolicyName},
+				DefaultExportPolicy: bgpconfig.DEFAULT_POLICY_TYPE_ACCEPT_ROUTE,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ebgp := &bgptable.PeerInfo{AS: 65001, Address: net.ParseIP("10.0.0.2")}
+	ibgp := &bgptable.PeerInfo{AS: 64512, Address: net.ParseIP("10.0.0.3")}
+	confed := &bgptable.PeerInfo{AS: 64513, Address: net.ParseIP("10.0.0.4")}
+	seq := uint8(bgp.BGP_ASPATH_ATTR_TYPE_SEQ)
+	for _, tc := range []struct {
+		name   string
+		path   *bgptable.Path
+		passed bool
+	}{
+		{"originated block", testPath(nil, "192.168.1.0/26", seq), true},
+		{"originated host", testPath(nil, "192.168.2.1/32", seq), true},
+		{"originated and prepended", testPath(nil, "192.168.1.0/26", seq, 64512, 64512), true},
+		{"eBGP learned", testPath(ebgp, "10.10.0.0/16", seq, 65001), false},
+		{"iBGP learned", testPath(ibgp, "10.20.0.0/16", seq), false},
+		{"confederation learned", testPath(confed, "10.30.0.0/16", bgp.BGP_ASPATH_ATTR_TYPE_CONFED_SEQ, 64513), false},
+		{"learned within an originated block", testPath(ebgp, "192.168.1.8/29", seq, 65001), false},
+		{"learned shorter than an originated block", testPath(ibgp, "192.168.0.0/16", seq), false},
+	} {
+		got := rp.ApplyPolicy(bgptable.GLOBAL_RIB_NAME, bgptable.POLICY_DIRECTION_EXPORT, tc.path, &bgptable.PolicyOptions{})
+		if passed := got != nil; passed != tc.passed {
+			t.Errorf("%s: passed %v, want %v", tc.name, passed, tc.passed)
+		}
+	}
+}
+
+func TestExportPoolsOnly(t *testing.T) {
+	pools, err := poolPrefixes([]ipPool{
+		ipPool{CIDR: "192.168.0.0/16"},
+		ipPool{CIDR: "172.16.0.0/16", Disabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := []string{"192.168.1.0/26", "172.16.1.0/26", "10.99.0.0/26"}
+	var aggregated, host []bgpconfig.Prefix
+	for _, block := range blocks {
+		aggregated = append(aggregated, bgpconfig.Prefix{IpPrefix: block})
+		host = append(host, bgpconfig.Prefix{IpPrefix: block, MasklengthRange: "27..32"})
+	}
+	seq := uint8(bgp.BGP_ASPATH_ATTR_TYPE_SEQ)
+	for _, poolsOnly := range []bool{false, true} {
+		rp := bgptable.NewRoutingPolicy()
+		err := rp.Reset(&bgpconfig.RoutingPolicy{
+			DefinedSets: bgpconfig.DefinedSets{
+				PrefixSets: []bgpconfig.PrefixSet{
+					bgpconfig.PrefixSet{PrefixSetName: aggregatedPrefixSetName, PrefixList: aggregated},
+					bgpconfig.PrefixSet{PrefixSetName: hostPrefixSetName, PrefixList: host},
+					bgpconfig.PrefixSet{PrefixSetName: poolPrefixSetName, PrefixList: pools},
+				},
+			},
+			PolicyDefinitions: []bgpconfig.PolicyDefinition{aggrPolicy(poolsOnly)},
+		}, map[string]bgpconfig.ApplyPolicy{
+			bgptable.GLOBAL_RIB_NAME: bgpconfig.ApplyPolicy{
+				Config: bgpconfig.ApplyPolicyConfig{
+					ExportPolicyList:    []string{aggrPolicyName},
+					DefaultExportPolicy: bgpconfig.DEFAULT_POLICY_TYPE_ACCEPT_ROUTE,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			name   string
+			prefix string
+			passed bool
+		}{
+			{"block in a pool", "192.168.1.0/26", true},
+			{"block in a disabled pool", "172.16.1.0/26", !poolsOnly},
+			{"block out of the pools", "10.99.0.0/26", !poolsOnly},
+			{"host route within a block", "192.168.1.8/32", false},
+		} {
+			got := rp.ApplyPolicy(bgptable.GLOBAL_RIB_NAME, bgptable.POLICY_DIRECTION_EXPORT, testPath(nil, tc.prefix, seq), &bgptable.PolicyOptions{})
+			if passed := got != nil; passed != tc.passed {
+				t.Errorf("pools only %t, %s: passed %t, want %t", poolsOnly, tc.name, passed, tc.passed)
+			}
+		}
+	}
+}
+
+func TestWithdrawnAcrossSync(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	advertise(t, s, "192.168.1.0/26", "192.168.1.64/26")
+
+	listed := s.applyWithdrawn(nil, map[string]bool{"192.168.1.0/26": true})
+	if advertised(t, s, "192.168.1.0/26") {
+		t.Fatal("192.168.1.0/26 is advertised after it's withdrawn")
+	}
+	if !advertised(t, s, "192.168.1.64/26") {
+		t.Fatal("192.168.1.64/26 isn't advertised")
+	}
+
+	// a sync advertises every assigned prefix again
+	advertise(t, s, "192.168.1.0/26", "192.168.1.64/26")
+	listed = s.applyWithdrawn(listed, map[string]bool{"192.168.1.0/26": true})
+	if advertised(t, s, "192.168.1.0/26") {
+		t.Fatal("192.168.1.0/26 is advertised by a sync while it's withdrawn")
+	}
+
+	listed = s.applyWithdrawn(listed, map[string]bool{})
+	if len(listed) != 0 {
+		t.Fatalf("%v are still withdrawn", listed)
+	}
+	if !advertised(t, s, "192.168.1.0/26") {
+		t.Fatal("192.168.1.0/26 isn't advertised after it's cleared")
+	}
+}
+
+func TestReadPrefixFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calico-bgp-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "withdrawn")
+	for _, tc := range []struct {
+		content string
+		want    map[string]bool
+		err     bool
+	}{
+		{"", map[string]bool{}, false},
+		{"# maintenance\n\n192.168.1.0/26\n", map[string]bool{"192.168.1.0/26": true}, false},
+		{" 192.168.1.1/26 \nfd00::/64", map[string]bool{"192.168.1.0/26": true, "fd00::/64": true}, false},
+		{"192.168.1.0", nil, true},
+	} {
+		if err = ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readPrefixFile(path)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v", tc.content, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.content, got, tc.want)
+		}
+	}
+	if got, err := readPrefixFile(filepath.Join(dir, "missing")); err != nil || len(got) != 0 {
+		t.Errorf("missing file: got %v, %v", got, err)
+	}
+}
+
+// testNeighbor returns a neighbor of 'addr' and 'asn' described as 'desc'
+func testNeighbor(addr string, asn uint32, desc string) *bgpconfig.Neighbor {
+	return &bgpconfig.Neighbor{
+		Config: bgpconfig.NeighborConfig{
+			NeighborAddress: addr,
+			PeerAs:          asn,
+			Description:     desc,
+		},
+	}
+}
+
+// neighborAddrs returns the sorted addresses of 'ns'
+func neighborAddrs(ns []*bgpconfig.Neighbor) []string {
+	addrs := make([]string, 0, len(ns))
+	for _, n := range ns {
+		addrs = append(addrs, n.Config.NeighborAddress)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestDiffStaticNeighbors(t *testing.T) {
+	a := testNeighbor("10.0.0.1", 65001, "Static_10_0_0_1")
+	b := testNeighbor("10.0.0.2", 65002, "Static_10_0_0_2")
+	b2 := testNeighbor("10.0.0.2", 65003, "Static_10_0_0_2")
+	c := testNeighbor("10.0.0.3", 65003, "Static_10_0_0_3")
+	byAddr := func(ns ...*bgpconfig.Neighbor) map[string]*bgpconfig.Neighbor {
+		m := make(map[string]*bgpconfig.Neighbor, len(ns))
+		for _, n := range ns {
+			m[n.Config.NeighborAddress] = n
+		}
+		return m
+	}
+	for _, tc := range []struct {
+		name       string
+		prev, cur  map[string]*bgpconfig.Neighbor
+		configured map[string]bool
+		added      []string
+		deleted    []string
+	}{
+		{"unchanged", byAddr(a, b), byAddr(a, b), nil, []string{}, []string{}},
+		{"added", byAddr(a), byAddr(a, b), nil, []string{"10.0.0.2"}, []string{}},
+		{"changed", byAddr(a, b), byAddr(a, b2), nil, []string{"10.0.0.2"}, []string{}},
+		{"deleted", byAddr(a, b, c), byAddr(b), nil, []string{}, []string{"10.0.0.1", "10.0.0.3"}},
+		{"taken over by a peer", byAddr(a, b), byAddr(a), map[string]bool{"10.0.0.2": true}, []string{}, []string{}},
+		{"first read", nil, byAddr(a), nil, []string{"10.0.0.1"}, []string{}},
+	} {
+		added, deleted := diffStaticNeighbors(tc.prev, tc.cur, tc.configured)
+		if got := neighborAddrs(added); !reflect.DeepEqual(got, tc.added) {
+			t.Errorf("%s: added %v, want %v", tc.name, got, tc.added)
+		}
+		if got := neighborAddrs(deleted); !reflect.DeepEqual(got, tc.deleted) {
+			t.Errorf("%s: deleted %v, want %v", tc.name, got, tc.deleted)
+		}
+	}
+}
+
+func TestSyncStatusStale(t *testing.T) {
+	st := newSyncStatus()
+	if got := st.stale(syncSubsystems, time.Hour); !reflect.DeepEqual(got, syncSubsystems) {
+		t.Fatalf("stale before any sync: %v", got)
+	}
+
+	before := time.Now()
+	st.markSynced("prefix")
+	last, ok := st.snapshot()["prefix"]
+	if !ok || last.Before(before) {
+		t.Fatalf("prefix sync didn't advance the time: %v", last)
+	}
+	if got := st.stale(syncSubsystems, time.Hour); !reflect.DeepEqual(got, []string{"bgpconfig", "ipam"}) {
+		t.Fatalf("stale after the prefix sync: %v", got)
+	}
+
+	// a failing subsystem doesn't mark its syncs
+	st.last["prefix"] = time.Now().Add(-2 * time.Hour)
+	st.markSynced("bgpconfig")
+	st.markSynced("ipam")
+	if got := st.stale(syncSubsystems, time.Hour); !reflect.DeepEqual(got, []string{"prefix"}) {
+		t.Fatalf("stale after the prefix sync failed for 2h: %v", got)
+	}
+
+	// a subsystem which doesn't run, e.g. prefix with advertise_blocks
+	// false, is never stale
+	st.disable("prefix")
+	if got := st.stale(syncSubsystems, time.Hour); len(got) != 0 {
+		t.Fatalf("stale with prefix disabled: %v", got)
+	}
+}
+
+func TestObserveOnly(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	s.observeOnly = true
+	prev := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	n := testNeighbor("10.0.0.3", 65003, "Global_10_0_0_3")
+	path, err := s.makePath("192.168.1.0/26", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const cycles = 3
+	for i := 0; i < cycles; i++ {
+		for _, f := range []func() error{
+			func() error { return s.addNeighbor(prev) },
+			func() error { return s.replaceNeighbor(prev, n) },
+			func() error { return s.deleteNeighbor(n) },
+			func() error { return s.addPath("", []*bgptable.Path{path}) },
+			func() error { return s.addPath("", []*bgptable.Path{path.Clone(true)}) },
+		} {
+			if err := f(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ns := s.bgpServer.GetNeighbor("", false); len(ns) != 0 {
+			t.Fatalf("cycle %d: %d neighbor(s) reached the BGP server", i, len(ns))
+		}
+		if advertised(t, s, "192.168.1.0/26") {
+			t.Fatalf("cycle %d: a path reached the BGP server", i)
+		}
+	}
+	want := map[string]int{
+		"add_neighbor":     cycles,
+		"replace_neighbor": cycles,
+		"delete_neighbor":  cycles,
+		"add_path":         cycles,
+		"withdraw_path":    cycles,
+	}
+	if got := s.observedCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("observed %v, want %v", got, want)
+	}
+}
+
+func TestChurnBreaker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		name      string
+		threshold int
+		// the changes, in seconds from the start
+		changes []int
+		want    []bool
+	}{
+		{"disabled", 0, []int{0, 0, 0, 0}, []bool{false, false, false, false}},
+		{"churn", 2, []int{0, 1, 2}, []bool{false, false, true}},
+		// the count starts over once the breaker trips
+		{"churn after tripping", 2, []int{0, 1, 2, 3, 4, 5}, []bool{false, false, true, false, false, true}},
+		{"quiet period", 2, []int{0, 1, 20, 21, 40}, []bool{false, false, false, false, false}},
+	} {
+		b := &churnBreaker{threshold: tc.threshold, window: 10 * time.Second}
+		var got []bool
+		for _, sec := range tc.changes {
+			got = append(got, b.record(start.Add(time.Duration(sec)*time.Second)))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: tripped %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestErrorLimiter(t *testing.T) {
+	var lines []string
+	logf := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	l := &errorLimiter{window: time.Hour}
+	for i := 0; i < 5; i++ {
+		l.log(logf, "etcd is down")
+	}
+	if !reflect.DeepEqual(lines, []string{"etcd is down"}) {
+		t.Fatalf("within the window: %q", lines)
+	}
+
+	l.logged = l.logged.Add(-time.Hour)
+	l.log(logf, "etcd is down")
+	if want := "still failing (5 occurrences): etcd is down"; len(lines) != 2 || lines[1] != want {
+		t.Fatalf("after the window: %q", lines)
+	}
+
+	l.log(logf, "etcd timed out")
+	if len(lines) != 3 || lines[2] != "etcd timed out" {
+		t.Fatalf("another error: %q", lines)
+	}
+
+	l.reset("recovered")
+	l.log(logf, "etcd timed out")
+	if len(lines) != 4 || lines[3] != "etcd timed out" {
+		t.Fatalf("the same error after it cleared: %q", lines)
+	}
+}
+
+func TestIsPermanentNeighborError(t *testing.T) {
+	for _, tc := range []struct {
+		msg       string
+		permanent bool
+	}{
+		{"Can't overwrite the existing peer: 10.0.0.1", true},
+		{"Can't delete a peer configuration for 10.0.0.1", true},
+		{"Neighbor that has 10.0.0.1 doesn't exist.", true},
+		{"NeighborAddress is not configured", true},
+		{"invalid AfiSafiType: ipv4-multicast", true},
+		{"timeout waiting for the BGP server", false},
+		{"dial tcp 10.0.0.1:179: invalid argument", false},
+		{"failed to update neighbor 10.0.0.1: Can't overwrite the existing peer: 10.0.0.1", false},
+	} {
+		if got := isPermanentNeighborError(errors.New(tc.msg)); got != tc.permanent {
+			t.Errorf("%q: permanent %v, want %v", tc.msg, got, tc.permanent)
+		}
+	}
+}
+
+func TestRetryNeighbor(t *testing.T) {
+	s := &Server{neighborRetries: 2}
+	n := testNeighbor("10.0.0.1", 65001, "Global_10_0_0_1")
+	for _, tc := range []struct {
+		name  string
+		errs  []error
+		calls int
+		err   bool
+	}{
+		{"success", []error{nil}, 1, false},
+		{"transient", []error{errors.New("busy"), nil}, 2, false},
+		{"exhausted", []error{errors.New("busy"), errors.New("busy"), errors.New("busy")}, 3, true},
+		{"permanent", []error{errors.New("Can't overwrite the existing peer: 10.0.0.1")}, 1, true},
+	} {
+		calls := 0
+		err := s.retryNeighbor("add", n, func(*bgpconfig.Neighbor) error {
+			err := tc.errs[calls]
+			calls++
+			return err
+		})
+		if calls != tc.calls || (err != nil) != tc.err {
+			t.Errorf("%s: %d call(s), error %v", tc.name, calls, err)
+		}
+	}
+}
+
+// peerChange returns the etcd response of the change of a global IPv4 peer
+// from 'prev' to 'cur'. An empty value is a peer which doesn't exist.
+func peerChange(action, prev, cur string) *etcd.Response {
+	key := CALICO_BGP + "/global/peer_v4/10.0.0.2"
+	res := &etcd.Response{Action: action, Node: &etcd.Node{Key: key, Value: cur}}
+	if prev != "" {
+		res.PrevNode = &etcd.Node{Key: key, Value: prev}
+	}
+	return res
+}
+
+func TestProtectedPeer(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	const (
+		protected   = `{"ip": "10.0.0.2", "as_num": "65002", "protected": true}`
+		moved       = `{"ip": "10.0.0.3", "as_num": "65002", "protected": true}`
+		unprotected = `{"ip": "10.0.0.3", "as_num": "65002", "protected": false}`
+	)
+	for _, tc := range []struct {
+		name string
+		res  *etcd.Response
+		want []string
+	}{
+		{"created", peerChange("set", "", protected), []string{"10.0.0.2"}},
+		{"deleted while protected", peerChange("delete", protected, ""), []string{"10.0.0.2"}},
+		{"address changed while protected", peerChange("set", protected, moved), []string{"10.0.0.2", "10.0.0.3"}},
+		{"protection removed", peerChange("set", moved, unprotected), []string{"10.0.0.2", "10.0.0.3"}},
+		{"deleted", peerChange("delete", unprotected, ""), []string{"10.0.0.2"}},
+	} {
+		if err := s.handlePeerChange(tc.res, "global", 64512); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := neighborAddrs(s.bgpServer.GetNeighbor("", false)); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: neighbors %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNodePeerFamilies(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	// change returns the change of the peer of 'addr' of node1 under the
+	// key of 'version'
+	change := func(action, version, addr string) *etcd.Response {
+		node := &etcd.Node{
+			Key:   fmt.Sprintf("%s/host/node1/peer_%s/%s", CALICO_BGP, version, addr),
+			Value: fmt.Sprintf(`{"ip": "%s", "as_num": "65002"}`, addr),
+		}
+		if action == "delete" {
+			return &etcd.Response{Action: action, PrevNode: node}
+		}
+		return &etcd.Response{Action: action, Node: node}
+	}
+	for _, tc := range []struct {
+		name string
+		res  *etcd.Response
+		err  bool
+		want []string
+	}{
+		{"IPv4 added", change("set", "v4", "10.0.0.2"), false, []string{"10.0.0.2"}},
+		{"IPv6 added", change("set", "v6", "fd00::2"), false, []string{"10.0.0.2", "fd00::2"}},
+		{"IPv4 deleted", change("delete", "v4", "10.0.0.2"), false, []string{"fd00::2"}},
+		{"IPv4 added again", change("set", "v4", "10.0.0.2"), false, []string{"10.0.0.2", "fd00::2"}},
+		{"IPv6 deleted", change("delete", "v6", "fd00::2"), false, []string{"10.0.0.2"}},
+		// an address of the other family is rejected, not applied
+		{"IPv6 address under peer_v4", change("set", "v4", "fd00::2"), true, []string{"10.0.0.2"}},
+		{"IPv4 address deleted under peer_v6", change("delete", "v6", "10.0.0.2"), true, []string{"10.0.0.2"}},
+	} {
+		err := s.handlePeerChange(tc.res, "node", 64512)
+		if (err != nil) != tc.err {
+			t.Fatalf("%s: error %v, want error %t", tc.name, err, tc.err)
+		}
+		if got := neighborAddrs(s.bgpServer.GetNeighbor("", false)); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: neighbors %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRefreshPeerChange(t *testing.T) {
+	const (
+		peer    = `{"ip": "10.0.0.2", "as_num": "65002"}`
+		prepend = `{"ip": "10.0.0.2", "as_num": "65002", "as_path_prepend": 2}`
+		moved   = `{"ip": "10.0.0.3", "as_num": "65002", "as_path_prepend": 2}`
+	)
+	for _, tc := range []struct {
+		name    string
+		refresh bool
+		cur     string
+		want    map[string]int
+	}{
+		{"policy changed with route refresh", true, prepend, map[string]int{"update_neighbor": 1, "soft_reset_neighbor": 1}},
+		{"policy changed without route refresh", false, prepend, map[string]int{"replace_neighbor": 1}},
+		{"address changed", true, moved, map[string]int{"replace_neighbor": 1}},
+	} {
+		n := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+		n.State.SessionState = bgpconfig.SESSION_STATE_ESTABLISHED
+		if tc.refresh {
+			n.State.RemoteCapabilityList = []bgp.ParameterCapabilityInterface{bgp.NewCapRouteRefresh()}
+		}
+		s := &Server{
+			observeOnly: true,
+			neighbors: func(string) []*bgpconfig.Neighbor {
+				return []*bgpconfig.Neighbor{n}
+			},
+		}
+		if err := s.handlePeerChange(peerChange("set", peer, tc.cur), "global", 64512); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := s.observedCounts(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHasRoutesWithin(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	advertise(t, s, "10.1.0.0/26", "10.2.0.0/26", "10.2.0.5/32", "fd00:1::/122", "fd00:2::5/128")
+	for _, tc := range []struct {
+		prefixes []string
+		want     bool
+	}{
+		// a block with only its own route
+		{[]string{"10.1.0.0/26"}, false},
+		{[]string{"10.2.0.0/26"}, true},
+		{[]string{"10.3.0.0/26"}, false},
+		{[]string{"10.1.0.0/26", "10.2.0.0/26"}, true},
+		{[]string{"fd00:1::/122"}, false},
+		{[]string{"fd00:2::/122"}, true},
+		{nil, false},
+	} {
+		got, err := s.hasRoutesWithin(tc.prefixes)
+		if err != nil {
+			t.Fatalf("%v: %s", tc.prefixes, err)
+		}
+		if got != tc.want {
+			t.Errorf("%v: %t, want %t", tc.prefixes, got, tc.want)
+		}
+	}
+}
+
+func TestPoolChangeRefresh(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	s.observeOnly = true
+	established := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	established.State.SessionState = bgpconfig.SESSION_STATE_ESTABLISHED
+	s.neighbors = func(string) []*bgpconfig.Neighbor {
+		return []*bgpconfig.Neighbor{established, testNeighbor("10.0.0.3", 65003, "Global_10_0_0_3")}
+	}
+	s.ipam = newIPAMCache(nil)
+	s.ipam.updateHandlers = append(s.ipam.updateHandlers, func(*ipPool) error { return s.updatePoolPrefixSet() })
+	if err := s.ipam.update(&etcd.Node{Value: `{"cidr":"192.168.0.0/16"}`}, false); err != nil {
+		t.Fatal(err)
+	}
+	// only the established neighbor is sent the routes again
+	want := map[string]int{"soft_reset_neighbor": 1}
+	if got := s.observedCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("%v, want %v", got, want)
+	}
+}
+
+func TestShutdownMessage(t *testing.T) {
+	defer os.Unsetenv(SHUTDOWN_MESSAGE)
+	n := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	for tmpl, want := range map[string]string{
+		"":                                      "",
+		"decommissioned":                        "decommissioned",
+		"{description} ({address}) was removed": "Global_10_0_0_2 (10.0.0.2) was removed",
+	} {
+		os.Setenv(SHUTDOWN_MESSAGE, tmpl)
+		if got := shutdownMessage(n); got != want {
+			t.Errorf("%q: %q, want %q", tmpl, got, want)
+		}
+	}
+}
+
+func TestDrainPaths(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	rd, _ := bgp.ParseRouteDistinguisher("64512:100")
+	rt, _ := bgp.ParseRouteTarget("64512:100")
+	rts := []bgp.ExtendedCommunityInterface{rt}
+	if err := s.bgpServer.AddVrf("red", 0, rd, rts, rts); err != nil {
+		t.Fatal(err)
+	}
+	s.vrf = "red"
+	advertise(t, s, "192.168.1.0/26")
+	path, err := s.makePath("192.168.2.0/26", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.addPath(s.vrf, []*bgptable.Path{path}); err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := s.vrfPaths(); err != nil || len(paths) != 1 {
+		t.Fatalf("VRF paths before the drain: %v, %v", paths, err)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.drainPaths(64512, 2, 500*time.Millisecond) }()
+	time.Sleep(100 * time.Millisecond)
+	paths, err := s.AdvertisedPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0].GetAsPathLen() != 2 {
+		t.Fatalf("paths while draining: %v", paths)
+	}
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if advertised(t, s, "192.168.1.0/26") {
+		t.Error("192.168.1.0/26 is advertised after the drain")
+	}
+	if paths, err := s.vrfPaths(); err != nil || len(paths) != 0 {
+		t.Errorf("VRF paths after the drain: %v, %v", paths, err)
+	}
+}
+
+func TestPathIDs(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	key := pathKey{prefix: "192.168.1.0/26"}
+	advertise(t, s, key.prefix)
+	first, ok := s.pathIDs[key]
+	if !ok {
+		t.Fatal("the identifier of the advertised path isn't stored")
+	}
+
+	advertise(t, s, key.prefix)
+	second, ok := s.pathIDs[key]
+	if !ok || reflect.DeepEqual(first, second) {
+		t.Fatalf("identifier after the path is advertised again: %v, want other than %v", second, first)
+	}
+	if !advertised(t, s, key.prefix) {
+		t.Fatal("the path advertised again isn't in the RIB")
+	}
+
+	path, err := s.makePath(key.prefix, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.addPath("", []*bgptable.Path{path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.pathIDs[key]; ok {
+		t.Error("the identifier is kept after the withdrawal")
+	}
+	if advertised(t, s, key.prefix) {
+		t.Error("the withdrawn path is still in the RIB")
+	}
+	// the identifier is released by gobgp when it's used for the withdrawal
+	if err = s.bgpServer.DeletePath(second, 0, "", nil); err == nil {
+		t.Error("the identifier of the withdrawn path is still known to gobgp")
+	}
+}
+
+// aggregated returns true when 'prefix' is in the 'aggregated' set
+func aggregated(t *testing.T, s *Server, prefix string) bool {
+	sets, err := s.bgpServer.GetDefinedSet(bgptable.DEFINED_TYPE_PREFIX, aggregatedPrefixSetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range sets.PrefixSets {
+		for _, p := range set.PrefixList {
+			if p.IpPrefix == prefix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// neighborSet returns the addresses in the neighbor-set 'name', none when
+// the BGP server has no such set
+func neighborSet(s *Server, name string) []string {
+	sets, err := s.bgpServer.GetDefinedSet(bgptable.DEFINED_TYPE_NEIGHBOR, name)
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for _, set := range sets.NeighborSets {
+		addrs = append(addrs, set.NeighborInfoList...)
+	}
+	return addrs
+}
+
+func TestPrependPolicy(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	v4 := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	v4.ApplyPolicy.Config.ExportPolicyList = []string{prependPolicyName(2)}
+	// an IPv6 session with the AS of IPV6_AS
+	v6 := testNeighbor("fd00::2", 65003, "Global_fd00__2")
+	v6.Config.LocalAs = 65100
+	v6.ApplyPolicy.Config.ExportPolicyList = []string{prependPolicyName(2)}
+	for _, n := range []*bgpconfig.Neighbor{v4, v6} {
+		if err := s.addNeighbor(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]bgpconfig.SetAsPathPrepend{
+		prependSetName(64512, 2): bgpconfig.SetAsPathPrepend{As: "64512", RepeatN: 2},
+		prependSetName(65100, 2): bgpconfig.SetAsPathPrepend{As: "65100", RepeatN: 2},
+	}
+	members := map[string]string{
+		prependSetName(64512, 2): "10.0.0.2",
+		prependSetName(65100, 2): "fd00::2",
+	}
+	got := make(map[string]bgpconfig.SetAsPathPrepend)
+	for _, p := range s.bgpServer.GetPolicy() {
+		if _, ok := want[p.Name]; ok && len(p.Statements) == 1 {
+			got[p.Name] = p.Statements[0].Actions.BgpActions.SetAsPathPrepend
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prepend policies %v, want %v", got, want)
+	}
+	for name, addr := range members {
+		if addrs := neighborSet(s, name); !reflect.DeepEqual(addrs, []string{addr}) {
+			t.Errorf("neighbor-set %s: %v, want [%s]", name, addrs, addr)
+		}
+	}
+
+	// the policies are bound to the export of the global RIB, before
+	// 'calico_aggr' accepts the routes
+	_, assigned, err := s.bgpServer.GetPolicyAssignment("", bgptable.POLICY_DIRECTION_EXPORT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range assigned {
+		names = append(names, p.Name)
+	}
+	if len(names) == 0 || names[len(names)-1] != aggrPolicyName {
+		t.Fatalf("export policies %v, want %s last", names, aggrPolicyName)
+	}
+	for name := range want {
+		found := false
+		for _, n := range names {
+			found = found || n == name
+		}
+		if !found {
+			t.Errorf("export policies %v, want %s in them", names, name)
+		}
+	}
+
+	if err = s.deleteNeighbor(v4); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := neighborSet(s, prependSetName(64512, 2)); len(addrs) != 0 {
+		t.Errorf("neighbor-set after the deletion: %v, want none", addrs)
+	}
+}
+
+func TestSummarizePools(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	s.summarizer = newPoolSummarizer(s)
+	s.ipam = newIPAMCache(nil, s.summarizePool)
+	pool := &etcd.Node{Value: `{"cidr":"192.168.0.0/25"}`}
+	blocks := []string{"192.168.0.0/26", "192.168.0.64/26"}
+	check := func(step string, summarized bool) {
+		if got := advertised(t, s, "192.168.0.0/25"); got != summarized {
+			t.Errorf("%s: pool advertised %t, want %t", step, got, summarized)
+		}
+		if got := aggregated(t, s, "192.168.0.0/25"); got != summarized {
+			t.Errorf("%s: pool in the aggregated set %t, want %t", step, got, summarized)
+		}
+		if got := advertised(t, s, blocks[0]); got == summarized {
+			t.Errorf("%s: block advertised %t, want %t", step, got, !summarized)
+		}
+	}
+
+	// the blocks are assigned before the pool is known
+	for _, block := range blocks {
+		path, err := s.makePath(block, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.addBlockPaths([]*bgptable.Path{path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("before the pool is added", false)
+	if err := s.ipam.update(pool, false); err != nil {
+		t.Fatal(err)
+	}
+	check("all blocks assigned", true)
+
+	path, err := s.makePath(blocks[1], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.addBlockPaths([]*bgptable.Path{path}); err != nil {
+		t.Fatal(err)
+	}
+	check("a block released", false)
+	if advertised(t, s, blocks[1]) {
+		t.Errorf("the released block %s is advertised", blocks[1])
+	}
+
+	path, err = s.makePath(blocks[1], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.addBlockPaths([]*bgptable.Path{path}); err != nil {
+		t.Fatal(err)
+	}
+	check("the block assigned again", true)
+	if err = s.ipam.update(pool, true); err != nil {
+		t.Fatal(err)
+	}
+	check("the pool deleted", false)
+}
+
+func TestParsePrefixList(t *testing.T) {
+	for _, tc := range []struct {
+		v       string
+		want    []bgpconfig.Prefix
+		wantErr bool
+	}{
+		{v: ""},
+		{v: " , "},
+		{
+			v:    "10.0.0.0/8",
+			want: []bgpconfig.Prefix{bgpconfig.Prefix{IpPrefix: "10.0.0.0/8"}},
+		},
+		{
+			v: "10.0.0.1/8 16..24, fd00::/64 64..128",
+			want: []bgpconfig.Prefix{
+				bgpconfig.Prefix{IpPrefix: "10.0.0.0/8", MasklengthRange: "16..24"},
+				bgpconfig.Prefix{IpPrefix: "fd00::/64", MasklengthRange: "64..128"},
+			},
+		},
+		{v: "10.0.0.0", wantErr: true},
+		{v: "10.0.0.0/8 16..24 extra", wantErr: true},
+		{v: "10.0.0.0/8 16-24", wantErr: true},
+		{v: "10.0.0.0/8 4..24", wantErr: true},
+		{v: "10.0.0.0/8 24..16", wantErr: true},
+		{v: "10.0.0.0/8 16..33", wantErr: true},
+	} {
+		got, err := parsePrefixList(tc.v)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parsePrefixList(%q): error %v, want error %t", tc.v, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parsePrefixList(%q) = %v, want %v", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"192.168.1.1", "192.168.1.1"},
+		{"::ffff:192.168.1.1", "192.168.1.1"},
+		{"FD00:0:0::1", "fd00::1"},
+		{"fd00:0000:0000:0000:0000:0000:0000:0001", "fd00::1"},
+		{"bgp.example.com", "bgp.example.com"},
+		{"", ""},
+	} {
+		if got := normalizeAddress(tc.addr); got != tc.want {
+			t.Errorf("normalizeAddress(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestParsePeerConfig(t *testing.T) {
+	os.Setenv(PRIVATE_PEER_PROFILE, `{"passive": true, "hold_time": 30}`)
+	defer os.Unsetenv(PRIVATE_PEER_PROFILE)
+	os.Setenv(PUBLIC_PEER_PROFILE, `{"password": "secret"}`)
+	defer os.Unsetenv(PUBLIC_PEER_PROFILE)
+	for _, tc := range []struct {
+		data    string
+		want    peerConfig
+		wantErr bool
+	}{
+		{
+			data: `{"ip": "10.0.0.2", "as_num": "64512"}`,
+			want: peerConfig{IP: "10.0.0.2", ASN: "64512", Passive: true, HoldTime: 30},
+		},
+		{
+			// the peer overrides its profile
+			data: `{"ip": "fd00::2", "as_num": "64512", "passive": false, "hold_time": 90}`,
+			want: peerConfig{IP: "fd00::2", ASN: "64512", HoldTime: 90},
+		},
+		{
+			data: `{"ip": "203.0.113.2", "as_num": "64513"}`,
+			want: peerConfig{IP: "203.0.113.2", ASN: "64513", Password: "secret"},
+		},
+		{
+			// a hostname has no profile
+			data: `{"ip": "bgp.example.com", "as_num": "64513"}`,
+			want: peerConfig{IP: "bgp.example.com", ASN: "64513"},
+		},
+		{data: `{"ip": "10.0.0.2"`, wantErr: true},
+	} {
+		got, err := parsePeerConfig([]byte(tc.data))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parsePeerConfig(%s): error %v, want error %t", tc.data, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("parsePeerConfig(%s) = %+v, want %+v", tc.data, *got, tc.want)
+		}
+	}
+
+	os.Setenv(PUBLIC_PEER_PROFILE, `{"password": `)
+	if _, err := parsePeerConfig([]byte(`{"ip": "203.0.113.2", "as_num": "64513"}`)); err == nil {
+		t.Error("an invalid profile is accepted")
+	}
+}
+
+func TestDedupNeighbors(t *testing.T) {
+	static := testNeighbor("10.0.0.2", 64512, "Static_10_0_0_2")
+	mesh := testNeighbor("10.0.0.2", 64512, "Mesh_10_0_0_2")
+	global := testNeighbor("10.0.0.2", 64513, "Global_10_0_0_2")
+	node := testNeighbor("10.0.0.2", 64514, "Node_10_0_0_2")
+	other := testNeighbor("10.0.0.3", 64512, "Mesh_10_0_0_3")
+	for _, tc := range []struct {
+		name string
+		ns   []*bgpconfig.Neighbor
+		want []*bgpconfig.Neighbor
+	}{
+		{"node-specific peer over all", []*bgpconfig.Neighbor{static, mesh, other, global, node}, []*bgpconfig.Neighbor{other, node}},
+		{"global peer over the mesh", []*bgpconfig.Neighbor{static, mesh, other, global}, []*bgpconfig.Neighbor{other, global}},
+		{"mesh over static", []*bgpconfig.Neighbor{static, mesh, other}, []*bgpconfig.Neighbor{mesh, other}},
+		{"no duplicate", []*bgpconfig.Neighbor{static, other}, []*bgpconfig.Neighbor{static, other}},
+	} {
+		if got := dedupNeighbors(tc.ns); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestValidateNeighbors(t *testing.T) {
+	defer os.Unsetenv(STRICT_VALIDATION)
+	s := &Server{ipv4: net.ParseIP("10.0.0.1"), ipv6: net.ParseIP("fd00::1")}
+	for _, tc := range []struct {
+		name     string
+		n        *bgpconfig.Neighbor
+		warnings int
+		errs     int
+	}{
+		{"valid", s.newNeighbor("10.0.0.2", 65002, "Global_10_0_0_2"), 0, 0},
+		{"invalid address", s.newNeighbor("10.0.0", 65002, "Global_10_0_0"), 0, 1},
+		{"no AS number", s.newNeighbor("10.0.0.2", 0, "Global_10_0_0_2"), 0, 1},
+		{"no family", &bgpconfig.Neighbor{Config: bgpconfig.NeighborConfig{NeighborAddress: "10.0.0.2", PeerAs: 65002}}, 0, 1},
+		{"no AS number nor family", &bgpconfig.Neighbor{Config: bgpconfig.NeighborConfig{NeighborAddress: "10.0.0.2"}}, 0, 2},
+		{"own IPv4 address", s.newNeighbor("10.0.0.1", 65002, "Global_10_0_0_1"), 1, 0},
+		{"own IPv6 address", s.newNeighbor("fd00::1", 65002, "Global_fd00__1"), 1, 0},
+	} {
+		ns := []*bgpconfig.Neighbor{s.newNeighbor("10.0.0.3", 65003, "Global_10_0_0_3"), tc.n}
+		warnings, errs := s.validateNeighbors(ns)
+		if len(warnings) != tc.warnings || len(errs) != tc.errs {
+			t.Errorf("%s: warnings %q, errors %q, want %d warning(s), %d error(s)", tc.name, warnings, errs, tc.warnings, tc.errs)
+		}
+		// the errors block applying only in strict mode
+		for _, strict := range []string{"", "true"} {
+			os.Setenv(STRICT_VALIDATION, strict)
+			err := s.checkNeighbors(ns)
+			if want := strict != "" && tc.errs > 0; (err != nil) != want {
+				t.Errorf("%s: strict %q: error %v, want error %t", tc.name, strict, err, want)
+			}
+		}
+	}
+}
+
+func TestGetDurationFromEnv(t *testing.T) {
+	const name = "CALICO_BGP_TEST_DURATION"
+	defer os.Unsetenv(name)
+	for _, tc := range []struct {
+		v       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{v: "", want: time.Minute},
+		{v: "0", want: 0},
+		{v: "90s", want: 90 * time.Second},
+		{v: "90", wantErr: true},
+	} {
+		os.Setenv(name, tc.v)
+		got, err := getDurationFromEnv(name, time.Minute)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("%q: %s, %v, want %s and error %t", tc.v, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestGetDrainPrepend(t *testing.T) {
+	defer os.Unsetenv(DRAIN_PREPEND)
+	for _, tc := range []struct {
+		v       string
+		want    uint8
+		wantErr bool
+	}{
+		{v: "", want: defaultDrainPrepend},
+		{v: "0", want: 0},
+		{v: "255", want: 255},
+		{v: "256", wantErr: true},
+		{v: "-1", wantErr: true},
+		{v: "three", wantErr: true},
+	} {
+		os.Setenv(DRAIN_PREPEND, tc.v)
+		got, err := getDrainPrepend()
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("%q: %d, %v, want %d and error %t", tc.v, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestGetBlackholeNexthops(t *testing.T) {
+	defer os.Unsetenv(BLACKHOLE_NEXTHOP)
+	prefixes := []string{"192.0.2.0/24", "2001:db8::/32"}
+	for _, tc := range []struct {
+		v        string
+		prefixes []string
+		want     map[bool]string
+		wantErr  bool
+	}{
+		{v: "", prefixes: prefixes, want: map[bool]string{}},
+		{v: "192.0.2.1", prefixes: prefixes[:1], want: map[bool]string{true: "192.0.2.1"}},
+		{v: "192.0.2.1, 2001:db8::1", prefixes: prefixes, want: map[bool]string{true: "192.0.2.1", false: "2001:db8::1"}},
+		// the IPv6 prefix has no next hop of its family
+		{v: "192.0.2.1", prefixes: prefixes, wantErr: true},
+		{v: "192.0.2.1,192.0.2.2", prefixes: prefixes[:1], wantErr: true},
+		{v: "blackhole", prefixes: prefixes[:1], wantErr: true},
+	} {
+		os.Setenv(BLACKHOLE_NEXTHOP, tc.v)
+		nexthops, err := getBlackholeNexthops(tc.prefixes)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: error %v, want error %t", tc.v, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		got := make(map[bool]string)
+		for v4, nexthop := range nexthops {
+			got[v4] = nexthop.String()
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: next hops %v, want %v", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestAdvertiseBlackholes(t *testing.T) {
+	defer os.Unsetenv(BLACKHOLE_COMMUNITY)
+	defer os.Unsetenv(BLACKHOLE_NEXTHOP)
+	for _, tc := range []struct {
+		name      string
+		community string
+		nexthop   string
+		want      uint32
+		// the next hop of the path; this node's address when empty
+		wantNexthop string
+	}{
+		{"default community", "", "", 65535<<16 | 666, "10.0.0.1"},
+		{"configured community", "64512:666", "", 64512<<16 | 666, "10.0.0.1"},
+		{"discard next hop", "", "192.0.2.1", 65535<<16 | 666, "192.0.2.1"},
+	} {
+		os.Setenv(BLACKHOLE_COMMUNITY, tc.community)
+		os.Setenv(BLACKHOLE_NEXTHOP, tc.nexthop)
+		s := newTestServer(t)
+		if err := s.advertiseBlackholes([]string{" 198.51.100.0/24", ""}); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		paths, err := s.AdvertisedPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != 1 || paths[0].GetNlri().String() != "198.51.100.0/24" {
+			t.Fatalf("%s: %v, want 198.51.100.0/24", tc.name, paths)
+		}
+		if got := paths[0].GetCommunities(); !reflect.DeepEqual(got, []uint32{tc.want}) {
+			t.Errorf("%s: communities %v, want [%d]", tc.name, got, tc.want)
+		}
+		if got := paths[0].GetNexthop().String(); got != tc.wantNexthop {
+			t.Errorf("%s: next hop %s, want %s", tc.name, got, tc.wantNexthop)
+		}
+		s.bgpServer.Stop()
+	}
+}
+
+func TestLogPrefixCounts(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	if err := s.bgpServer.AddNeighbor(testNeighbor("192.0.2.2", 64513, "Global_192_0_2_2")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	s.t.Go(func() error { return s.logPrefixCounts(10 * time.Millisecond) })
+	time.Sleep(100 * time.Millisecond)
+	s.t.Kill(nil)
+	if err := s.t.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, field := range []string{"neighbor=192.0.2.2", "received=0", "accepted=0", "advertised=0"} {
+		if !strings.Contains(out, field) {
+			t.Errorf("%s isn't logged in %q", field, out)
+		}
+	}
+}
+
+func TestReportPrefixCounts(t *testing.T) {
+	n1 := testNeighbor("192.0.2.2", 64513, "Global_192_0_2_2")
+	n1.State.AdjTable = bgpconfig.AdjTable{Received: 10, Accepted: 8, Advertised: 3}
+	n2 := testNeighbor("192.0.2.3", 64514, "Global_192_0_2_3")
+	n2.State.AdjTable = bgpconfig.AdjTable{Advertised: 5}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	metric := func() map[string]map[string]int {
+		var m map[string]map[string]int
+		if err := json.Unmarshal([]byte(expvar.Get("calico_bgp_prefix_counts").String()), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	reportPrefixCounts([]*bgpconfig.Neighbor{n1, n2})
+	want := map[string]map[string]int{
+		"192.0.2.2": {"received": 10, "accepted": 8, "advertised": 3},
+		"192.0.2.3": {"received": 0, "accepted": 0, "advertised": 5},
+	}
+	if got := metric(); !reflect.DeepEqual(got, want) {
+		t.Errorf("metric %v, want %v", got, want)
+	}
+	for _, field := range []string{"neighbor=192.0.2.2", "received=10", "accepted=8", "advertised=3", "neighbor=192.0.2.3", "advertised=5"} {
+		if !strings.Contains(buf.String(), field) {
+			t.Errorf("%s isn't logged in %q", field, buf.String())
+		}
+	}
+
+	// a neighbor deleted since the last report is dropped
+	reportPrefixCounts([]*bgpconfig.Neighbor{n2})
+	delete(want, "192.0.2.2")
+	if got := metric(); !reflect.DeepEqual(got, want) {
+		t.Errorf("metric after the deletion %v, want %v", got, want)
+	}
+}
+
+func TestMaxNeighbors(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	s.maxNeighbors = 2
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	skipped := neighborsSkippedMetric.Value()
+	for _, addr := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		if err := s.addNeighbor(testNeighbor(addr, 65002, "Global_"+underscore(addr))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := neighborAddrs(s.bgpServer.GetNeighbor("", false)); !reflect.DeepEqual(got, []string{"10.0.0.2", "10.0.0.3"}) {
+		t.Errorf("neighbors %v, want the first two", got)
+	}
+	if got := neighborsSkippedMetric.Value() - skipped; got != 1 {
+		t.Errorf("%d neighbors counted as skipped, want 1", got)
+	}
+	if want := "skip neighbor 10.0.0.4: already 2 neighbors"; !strings.Contains(buf.String(), want) {
+		t.Errorf("%q isn't logged in %q", want, buf.String())
+	}
+
+	// an existing neighbor is updated, not skipped
+	if err := s.addNeighbor(testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")); err != nil {
+		t.Fatal(err)
+	}
+	if got := neighborsSkippedMetric.Value() - skipped; got != 1 {
+		t.Errorf("%d neighbors counted as skipped after an update, want 1", got)
+	}
+}
+
+func TestMeshConfig(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		v4, v6  bool
+		wantErr bool
+	}{
+		{value: `{"enabled": true}`, v4: true, v6: true},
+		{value: `{"enabled": false}`},
+		{value: `{"enabled": true, "ipv6": false}`, v4: true},
+		{value: `{"enabled": false, "ipv6": true}`, v6: true},
+		{value: `{"enabled": true, "ipv4": false, "ipv6": false}`},
+		{value: `{"enabled": "yes"}`, wantErr: true},
+	} {
+		c, err := parseMeshConfig(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: error %v, want error %t", tc.value, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if v4, v6 := c.enabled(true), c.enabled(false); v4 != tc.v4 || v6 != tc.v6 {
+			t.Errorf("%s: enabled for IPv4 %t and IPv6 %t, want %t and %t", tc.value, v4, v6, tc.v4, tc.v6)
+		}
+	}
+}
+
+func TestNeighborFromPeerConfigMultihop(t *testing.T) {
+	s := &Server{}
+	for _, tc := range []struct {
+		name    string
+		m       peerConfig
+		enabled bool
+		ttl     uint8
+	}{
+		{"eBGP peer", peerConfig{IP: "192.0.2.2", ASN: "64513", MultihopTTL: 3}, true, 3},
+		{"eBGP peer without a TTL", peerConfig{IP: "192.0.2.2", ASN: "64513"}, false, 0},
+		{"iBGP peer", peerConfig{IP: "192.0.2.2", ASN: "64512", MultihopTTL: 3}, false, 0},
+	} {
+		m := tc.m
+		n, err := s.neighborFromPeerConfig(&m, "global", 64512)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if c := n.EbgpMultihop.Config; c.Enabled != tc.enabled || c.MultihopTtl != tc.ttl {
+			t.Errorf("%s: multihop %t with TTL %d, want %t with TTL %d", tc.name, c.Enabled, c.MultihopTtl, tc.enabled, tc.ttl)
+		}
+	}
+}
+
+func TestNeighborAddPaths(t *testing.T) {
+	s := &Server{}
+	for _, tc := range []struct {
+		name    string
+		m       peerConfig
+		receive bool
+		sendMax uint8
+	}{
+		{"unset", peerConfig{IP: "192.0.2.2", ASN: "64513"}, false, 0},
+		{"receive", peerConfig{IP: "192.0.2.2", ASN: "64513", AddPathsReceive: true}, true, 0},
+		{"send", peerConfig{IP: "192.0.2.2", ASN: "64513", AddPathsSendMax: 4}, false, 4},
+		{"both", peerConfig{IP: "192.0.2.2", ASN: "64513", AddPathsReceive: true, AddPathsSendMax: 2}, true, 2},
+	} {
+		m := tc.m
+		n, err := s.neighborFromPeerConfig(&m, "global", 64512)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if c := n.AddPaths.Config; c.Receive != tc.receive || c.SendMax != tc.sendMax {
+			t.Errorf("%s: receive %t, send max %d, want %t, %d", tc.name, c.Receive, c.SendMax, tc.receive, tc.sendMax)
+		}
+	}
+}
+
+func TestExtendedPeer(t *testing.T) {
+	s := &Server{}
+	key := fmt.Sprintf("%s/global/peer_v4/192.0.2.2", CALICO_BGP)
+	for _, tc := range []struct {
+		name     string
+		value    string
+		err      bool
+		families []bgpconfig.AfiSafiType
+		source   string
+		password string
+	}{
+		{
+			name:     "simple",
+			value:    `{"ip": "192.0.2.2", "as_num": "64513"}`,
+			families: []bgpconfig.AfiSafiType{bgpconfig.AFI_SAFI_TYPE_IPV4_UNICAST},
+		},
+		{
+			name:     "extended",
+			value:    `{"ip": "192.0.2.2", "as_num": "64513", "families": ["ipv4-unicast", "l3vpn-ipv4-unicast"], "source_address": "192.0.2.1", "password": "secret"}`,
+			families: []bgpconfig.AfiSafiType{bgpconfig.AFI_SAFI_TYPE_IPV4_UNICAST, bgpconfig.AFI_SAFI_TYPE_L3VPN_IPV4_UNICAST},
+			source:   "192.0.2.1",
+			password: "secret",
+		},
+		{name: "invalid family", value: `{"ip": "192.0.2.2", "as_num": "64513", "families": ["ipv5-unicast"]}`, err: true},
+		{name: "invalid source address", value: `{"ip": "192.0.2.2", "as_num": "64513", "source_address": "source"}`, err: true},
+	} {
+		n, err := s.getNeighborConfigFromPeer(&etcd.Node{Key: key, Value: tc.value}, "global", 64512)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, want error %t", tc.name, err, tc.err)
+		}
+		if err != nil {
+			continue
+		}
+		var families []bgpconfig.AfiSafiType
+		for _, a := range n.AfiSafis {
+			families = append(families, a.Config.AfiSafiName)
+		}
+		if !reflect.DeepEqual(families, tc.families) {
+			t.Errorf("%s: families %v, want %v", tc.name, families, tc.families)
+		}
+		if got := n.Transport.Config.LocalAddress; got != tc.source {
+			t.Errorf("%s: source address %q, want %q", tc.name, got, tc.source)
+		}
+		if got := n.Config.AuthPassword; got != tc.password {
+			t.Errorf("%s: password %q, want %q", tc.name, got, tc.password)
+		}
+	}
+}
+
+func TestHostnamePeer(t *testing.T) {
+	os.Setenv(RESOLVE_INTERVAL, "1m")
+	defer os.Unsetenv(RESOLVE_INTERVAL)
+	addrs := map[string][]net.IP{
+		"peer.example": {net.ParseIP("2001:db8::2"), net.ParseIP("192.0.2.2")},
+	}
+	s := &Server{
+		observeOnly: true,
+		lookupIP: func(host string) ([]net.IP, error) {
+			ips, ok := addrs[host]
+			if !ok {
+				return nil, fmt.Errorf("no such host %s", host)
+			}
+			return ips, nil
+		},
+		// the neighbors are all still configured
+		neighbors: func(addr string) []*bgpconfig.Neighbor {
+			return []*bgpconfig.Neighbor{testNeighbor(addr, 64513, "Global_peer_example")}
+		},
+	}
+	node := &etcd.Node{
+		Key:   fmt.Sprintf("%s/global/peer_v4/peer.example", CALICO_BGP),
+		Value: `{"ip": "peer.example", "as_num": "64513"}`,
+	}
+	n, err := s.getNeighborConfigFromPeer(node, "global", 64512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the address of the family of the key
+	if got := n.Config.NeighborAddress; got != "192.0.2.2" {
+		t.Errorf("address %s, want 192.0.2.2", got)
+	}
+	if got := n.Config.Description; got != "Global_peer_example" {
+		t.Errorf("description %s, want Global_peer_example", got)
+	}
+
+	errs := make(map[string]*errorLimiter)
+	for _, tc := range []struct {
+		name string
+		ips  []net.IP
+		want string
+		// the number of times the neighbor has been replaced
+		replaced int
+	}{
+		{"unchanged", []net.IP{net.ParseIP("192.0.2.2")}, "192.0.2.2", 0},
+		{"moved", []net.IP{net.ParseIP("192.0.2.3")}, "192.0.2.3", 1},
+		// retried next time
+		{"failed to resolve", nil, "192.0.2.3", 1},
+		{"moved again", []net.IP{net.ParseIP("192.0.2.4")}, "192.0.2.4", 2},
+	} {
+		delete(addrs, "peer.example")
+		if tc.ips != nil {
+			addrs["peer.example"] = tc.ips
+		}
+		if err = s.reresolvePeers(errs); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := s.hostnamePeers["peer.example"].Config.NeighborAddress; got != tc.want {
+			t.Errorf("%s: address %s, want %s", tc.name, got, tc.want)
+		}
+		if got := s.observedCounts()["replace_neighbor"]; got != tc.replaced {
+			t.Errorf("%s: replaced %d time(s), want %d", tc.name, got, tc.replaced)
+		}
+	}
+}
+
+func TestUnnumberedNeighbors(t *testing.T) {
+	s := &Server{
+		linkLocalNeighbor: func(iface string) (string, error) {
+			switch iface {
+			case "eth0":
+				return "fe80::1%eth0", nil
+			case "eth1":
+				return "fe80::2%eth1", nil
+			}
+			return "", fmt.Errorf("no neighbor found on %s", iface)
+		},
+	}
+	for _, tc := range []struct {
+		name    string
+		entries []string
+		want    []string
+		err     bool
+	}{
+		{"interfaces", []string{"eth0:65001", " eth1:65002", ""}, []string{"fe80::1%eth0", "fe80::2%eth1"}, false},
+		// an interface without a router is skipped
+		{"no router", []string{"eth0:65001", "eth2:65003"}, []string{"fe80::1%eth0"}, false},
+		{"no AS number", []string{"eth0"}, nil, true},
+		{"invalid AS number", []string{"eth0:as"}, nil, true},
+	} {
+		ns, err := s.getUnnumberedNeighborConfigs(tc.entries)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, want error %t", tc.name, err, tc.err)
+		}
+		if err != nil {
+			continue
+		}
+		if got := neighborAddrs(ns); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: neighbors %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// the neighbor is bound to its interface with the IPv6 family
+	ns, err := s.getUnnumberedNeighborConfigs([]string{"eth0:65001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := ns[0]
+	if n.Config.NeighborInterface != "eth0" || n.Config.PeerAs != 65001 || n.Config.Description != "Unnumbered_eth0" {
+		t.Errorf("neighbor %+v, want one over eth0 with AS 65001", n.Config)
+	}
+	if len(n.AfiSafis) != 1 || n.AfiSafis[0].Config.AfiSafiName != bgpconfig.AFI_SAFI_TYPE_IPV6_UNICAST {
+		t.Errorf("families %v, want IPv6 unicast", n.AfiSafis)
+	}
+}
+
+func TestNeighborFamilies(t *testing.T) {
+	v4 := bgpconfig.AFI_SAFI_TYPE_IPV4_UNICAST
+	v6 := bgpconfig.AFI_SAFI_TYPE_IPV6_UNICAST
+	for _, tc := range []struct {
+		name     string
+		families []bgpconfig.AfiSafiType
+		addr     string
+		want     []bgpconfig.AfiSafiType
+	}{
+		{"IPv4 peer", nil, "192.0.2.2", []bgpconfig.AfiSafiType{v4}},
+		{"IPv6 peer", nil, "2001:db8::2", []bgpconfig.AfiSafiType{v6}},
+		{"overridden", []bgpconfig.AfiSafiType{v4, v6}, "2001:db8::2", []bgpconfig.AfiSafiType{v4, v6}},
+	} {
+		s := &Server{families: tc.families}
+		n := s.newNeighbor(tc.addr, 64513, "Global")
+		var got []bgpconfig.AfiSafiType
+		for _, a := range n.AfiSafis {
+			if a.Config.Enabled {
+				got = append(got, a.Config.AfiSafiName)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: families %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStaleTime(t *testing.T) {
+	defer os.Unsetenv(GRACEFUL_RESTART_STALE_TIME)
+	for _, tc := range []struct {
+		value string
+		want  uint32
+		err   bool
+	}{
+		{"", 0, false},
+		{"90s", 90, false},
+		{"2h", 7200, false},
+		{"-1s", 0, true},
+		// over the 24 bits of the long-lived stale time
+		{"5000h", 0, true},
+		{"stale", 0, true},
+	} {
+		os.Setenv(GRACEFUL_RESTART_STALE_TIME, tc.value)
+		staleTime, err := getStaleTime()
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v, want error %t", tc.value, err, tc.err)
+			continue
+		}
+		if staleTime != tc.want {
+			t.Errorf("%q: %d, want %d", tc.value, staleTime, tc.want)
+			continue
+		}
+
+		s := &Server{staleTime: staleTime}
+		n := s.newNeighbor("192.0.2.2", 64513, "Global")
+		if gr := n.GracefulRestart.Config; gr.Enabled != (tc.want > 0) || gr.LongLivedEnabled != (tc.want > 0) {
+			t.Errorf("%q: graceful restart %+v, want enabled %t", tc.value, gr, tc.want > 0)
+		}
+		for _, a := range n.AfiSafis {
+			if got := a.LongLivedGracefulRestart.Config.RestartTime; got != tc.want {
+				t.Errorf("%q: %s stale time %d, want %d", tc.value, a.Config.AfiSafiName, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{NODENAME, MRAI, LISTEN_PORT, EXPORT_LEARNED_ROUTES} {
+		defer os.Unsetenv(name)
+	}
+	for _, tc := range []struct {
+		name    string
+		content string
+		// set in the environment before the file is loaded
+		env  map[string]string
+		want map[string]string
+		err  string
+	}{
+		{
+			name:    "loaded",
+			content: `{"NODENAME": "node1", "CALICO_BGP_LISTEN_PORT": 1179, "CALICO_BGP_EXPORT_LEARNED_ROUTES": true}`,
+			want:    map[string]string{NODENAME: "node1", LISTEN_PORT: "1179", EXPORT_LEARNED_ROUTES: "true"},
+		},
+		{
+			name:    "overridden by the environment",
+			content: `{"NODENAME": "node1", "CALICO_BGP_MRAI": "10s"}`,
+			env:     map[string]string{NODENAME: "node2"},
+			want:    map[string]string{NODENAME: "node2", MRAI: "10s"},
+		},
+		{name: "syntax error", content: "{\n\"NODENAME\": \"node1\",\n}", err: "line 3"},
+		{name: "invalid value", content: `{"NODENAME": ["node1"]}`, err: "NODENAME"},
+	} {
+		for _, name := range []string{NODENAME, MRAI, LISTEN_PORT, EXPORT_LEARNED_ROUTES} {
+			os.Unsetenv(name)
+		}
+		for name, v := range tc.env {
+			os.Setenv(name, v)
+		}
+		path := filepath.Join(dir, "config.json")
+		if err = ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err = loadConfigFile(path)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %v, want one with %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		for name, want := range tc.want {
+			if got := os.Getenv(name); got != want {
+				t.Errorf("%s: %s=%q, want %q", tc.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestZebraConfig(t *testing.T) {
+	defer os.Unsetenv(ZEBRA_VERSION)
+	defer os.Unsetenv(ZEBRA_REDISTRIBUTE)
+	const url = "unix:/var/run/quagga/zserv.api"
+	for _, tc := range []struct {
+		name         string
+		version      string
+		redistribute string
+		want         *bgpconfig.ZebraConfig
+	}{
+		{"default", "", "", &bgpconfig.ZebraConfig{Enabled: true, Url: url, Version: defaultZebraVersion}},
+		{"configured", "3", "connect, static,", &bgpconfig.ZebraConfig{
+			Enabled:                   true,
+			Url:                       url,
+			RedistributeRouteTypeList: []bgpconfig.InstallProtocolType{"connect", "static"},
+			Version:                   3,
+		}},
+		{"invalid version", "two", "", nil},
+		{"version out of range", "258", "", nil},
+	} {
+		os.Setenv(ZEBRA_VERSION, tc.version)
+		os.Setenv(ZEBRA_REDISTRIBUTE, tc.redistribute)
+		c, err := zebraConfig(url)
+		if (err != nil) != (tc.want == nil) {
+			t.Errorf("%s: error %v, want error %t", tc.name, err, tc.want == nil)
+			continue
+		}
+		if !reflect.DeepEqual(c, tc.want) {
+			t.Errorf("%s: %+v, want %+v", tc.name, c, tc.want)
+		}
+	}
+}
+
+func TestNeighborPassive(t *testing.T) {
+	s := &Server{}
+	for _, passive := range []bool{false, true} {
+		m := peerConfig{IP: "192.0.2.2", ASN: "64513", Passive: passive}
+		n, err := s.neighborFromPeerConfig(&m, "global", 64512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := n.Transport.Config.PassiveMode; got != passive {
+			t.Errorf("passive mode %t, want %t", got, passive)
+		}
+	}
+}
+
+func TestNeighborMRAI(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mrai float64
+		m    peerConfig
+		want float64
+	}{
+		{"unset", 0, peerConfig{IP: "192.0.2.2", ASN: "64513"}, 0},
+		{"global", 5, peerConfig{IP: "192.0.2.2", ASN: "64513"}, 5},
+		{"per peer", 0, peerConfig{IP: "192.0.2.2", ASN: "64513", MRAI: 1.5}, 1.5},
+		{"per peer over global", 5, peerConfig{IP: "192.0.2.2", ASN: "64513", MRAI: 1.5}, 1.5},
+	} {
+		s := &Server{mrai: tc.mrai}
+		m := tc.m
+		n, err := s.neighborFromPeerConfig(&m, "global", 64512)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if got := n.Timers.Config.MinimumAdvertisementInterval; got != tc.want {
+			t.Errorf("%s: peer MRAI %v, want %v", tc.name, got, tc.want)
+		}
+		if got := s.newMeshNeighbor("192.0.2.3", 64512).Timers.Config.MinimumAdvertisementInterval; got != tc.mrai {
+			t.Errorf("%s: mesh neighbor MRAI %v, want %v", tc.name, got, tc.mrai)
+		}
+	}
+}
+
+func TestAdvertiseDefaultRoutes(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	if err := s.advertiseDefaultRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"0.0.0.0/0", "::/0"} {
+		if !advertised(t, s, prefix) {
+			t.Errorf("%s isn't advertised", prefix)
+		}
+		if !aggregated(t, s, prefix) {
+			t.Errorf("%s isn't in the aggregated set", prefix)
+		}
+	}
+
+	// a node without an IPv6 address originates the IPv4 one only
+	s = newTestServer(t)
+	defer s.bgpServer.Stop()
+	s.ipv6 = nil
+	if err := s.advertiseDefaultRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	if !advertised(t, s, "0.0.0.0/0") || advertised(t, s, "::/0") {
+		t.Error("the default routes of an IPv4-only node are wrong")
+	}
+}
+
+func TestAddNeighbors(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	ns := []*bgpconfig.Neighbor{
+		testNeighbor("192.0.2.2", 64513, "Global_192_0_2_2"),
+		testNeighbor("192.0.2.3", 64513, "Global_192_0_2_3"),
+		testNeighbor("192.0.2.4", 64513, "Global_192_0_2_4"),
+		testNeighbor("192.0.2.5", 64513, "Global_192_0_2_5"),
+	}
+	ns[1].AfiSafis = []bgpconfig.AfiSafi{
+		bgpconfig.AfiSafi{
+			Config: bgpconfig.AfiSafiConfig{AfiSafiName: "invalid", Enabled: true},
+		},
+	}
+	err := s.addNeighbors(ns, 2)
+	if err == nil || !strings.Contains(err.Error(), "failed to add 1 neighbor(s): 192.0.2.3: ") {
+		t.Errorf("error = %v, want the failure of 192.0.2.3", err)
+	}
+	got := neighborAddrs(s.bgpServer.GetNeighbor("", false))
+	if want := []string{"192.0.2.2", "192.0.2.4", "192.0.2.5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("neighbors %v, want %v", got, want)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	for _, tc := range []struct {
+		prefix  string
+		nexthop string
+		wantErr bool
+	}{
+		{prefix: "192.168.1.0/26"},
+		{prefix: "192.168.1.0/26", nexthop: "198.51.100.1"},
+		{prefix: "fd00::/122", nexthop: "2001:db8::2"},
+		{prefix: "192.168.1.0/26", nexthop: "next-hop", wantErr: true},
+		{prefix: "192.168.1.0", wantErr: true},
+	} {
+		if err := selfTest(tc.prefix, tc.nexthop); (err != nil) != tc.wantErr {
+			t.Errorf("selfTest(%q, %q): error %v, want error %t", tc.prefix, tc.nexthop, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAddNeighborExisting(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	if err := s.addNeighbor(testNeighbor("192.0.2.2", 64513, "Global_192_0_2_2")); err != nil {
+		t.Fatal(err)
+	}
+	// e.g. a retry of a partial apply adds the neighbor again
+	if err := s.addNeighbor(testNeighbor("192.0.2.2", 64513, "Global_192_0_2_2")); err != nil {
+		t.Fatalf("adding the same neighbor again: %s", err)
+	}
+	if err := s.addNeighbor(testNeighbor("192.0.2.2", 64514, "Node_192_0_2_2")); err != nil {
+		t.Fatalf("adding the neighbor with another configuration: %s", err)
+	}
+	ns := s.bgpServer.GetNeighbor("", false)
+	if len(ns) != 1 {
+		t.Fatalf("neighbors %v, want 192.0.2.2 only", neighborAddrs(ns))
+	}
+	if c := ns[0].Config; c.PeerAs != 64514 || c.Description != "Node_192_0_2_2" {
+		t.Errorf("neighbor AS %d and description %q, want the last configuration", c.PeerAs, c.Description)
+	}
+}
+
+// failingWatcher fails 'failures' times before it returns a response
+type failingWatcher struct {
+	failures int
+	err      error
+}
+
+func (w *failingWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	if w.failures > 0 {
+		w.failures--
+		return nil, w.err
+	}
+	return &etcd.Response{Action: "set"}, nil
+}
+
+func TestStaleWatcher(t *testing.T) {
+	unavailable := errors.New("client: etcd cluster is unavailable or misconfigured")
+	cleared := etcd.Error{Code: etcd.ErrorCodeEventIndexCleared}
+	for _, tc := range []struct {
+		name    string
+		limit   string
+		err     error
+		wantErr bool
+	}{
+		{name: "no limit", err: unavailable},
+		{name: "within the limit", limit: "1m", err: unavailable},
+		{name: "over the limit", limit: "1ns", err: unavailable, wantErr: true},
+		{name: "index cleared", err: cleared, wantErr: true},
+	} {
+		os.Setenv(STALE_LIMIT, tc.limit)
+		w, err := newStaleWatcher("test", &failingWatcher{failures: 3, err: tc.err})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.retryWait = time.Millisecond
+		res, err := w.Next(context.Background())
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: %v, want an error", tc.name, res)
+			}
+		} else if err != nil || res == nil {
+			t.Errorf("%s: %v, %v, want the response after the failures", tc.name, res, err)
+		}
+	}
+	os.Unsetenv(STALE_LIMIT)
+}
+
+func TestNodeCommunity(t *testing.T) {
+	os.Setenv(NODENAME, "node1")
+	defer os.Unsetenv(NODENAME)
+	defer os.Unsetenv(NODE_COMMUNITY)
+	h := fnv.New32a()
+	h.Write([]byte("node1"))
+	for _, tc := range []struct {
+		value string
+		want  *bgp.LargeCommunity
+		err   bool
+	}{
+		{"", nil, false},
+		{"65000:7", bgp.NewLargeCommunity(65000, 7, 0), false},
+		{"65000", bgp.NewLargeCommunity(65000, h.Sum32(), 0), false},
+		{"as65000", nil, true},
+		{"65000:node1", nil, true},
+		{"65000:7:0", nil, true},
+	} {
+		os.Setenv(NODE_COMMUNITY, tc.value)
+		got, err := getNodeCommunity()
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v, want error %t", tc.value, err, tc.err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: community %v, want %v", tc.value, got, tc.want)
+		}
+	}
+
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	s.nodeCommunity = bgp.NewLargeCommunity(65000, 7, 0)
+	advertise(t, s, "192.168.1.0/26")
+	paths, err := s.AdvertisedPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("advertised %d paths, want 1", len(paths))
+	}
+	var found bool
+	for _, a := range paths[0].GetPathAttrs() {
+		if lc, ok := a.(*bgp.PathAttributeLargeCommunities); ok {
+			found = reflect.DeepEqual(lc.Values, []*bgp.LargeCommunity{s.nodeCommunity})
+		}
+	}
+	if !found {
+		t.Errorf("the advertised path doesn't have the community 65000:7:0: %v", paths[0].GetPathAttrs())
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want uint8
+		err  bool
+	}{
+		{"", bgp.BGP_ORIGIN_ATTR_TYPE_IGP, false},
+		{"igp", bgp.BGP_ORIGIN_ATTR_TYPE_IGP, false},
+		{"EGP", bgp.BGP_ORIGIN_ATTR_TYPE_EGP, false},
+		{"incomplete", bgp.BGP_ORIGIN_ATTR_TYPE_INCOMPLETE, false},
+		{"bgp", 0, true},
+	} {
+		origin, err := parseOrigin(tc.name)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v, want error %t", tc.name, err, tc.err)
+		}
+		if err != nil {
+			continue
+		}
+		s := &Server{ipv4: net.ParseIP("10.0.0.1"), origin: origin}
+		path, err := s.makePath("192.168.1.0/26", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, a := range path.GetPathAttrs() {
+			if o, ok := a.(*bgp.PathAttributeOrigin); ok {
+				found = reflect.DeepEqual(o, bgp.NewPathAttributeOrigin(tc.want))
+			}
+		}
+		if !found {
+			t.Errorf("%q: the path doesn't have the origin %d: %v", tc.name, tc.want, path.GetPathAttrs())
+		}
+	}
+}
+
+func TestMED(t *testing.T) {
+	defer os.Unsetenv(MED)
+	defer os.Unsetenv(MED_OVERRIDES)
+	for _, tc := range []struct {
+		name      string
+		med       string
+		overrides string
+		err       bool
+		// the MED of 192.168.1.0/26 and 192.168.2.0/26; -1 is unset
+		want [2]int64
+	}{
+		{"unset", "", "", false, [2]int64{-1, -1}},
+		{"set", "100", "", false, [2]int64{100, 100}},
+		{"overridden", "100", " 192.168.2.0/26 = 50", false, [2]int64{100, 50}},
+		{"overridden only", "", "192.168.2.1/26=0", false, [2]int64{-1, 0}},
+		{"invalid", "-1", "", true, [2]int64{}},
+		{"invalid override", "", "192.168.2.0/26", true, [2]int64{}},
+		{"invalid override prefix", "", "192.168.2.0=50", true, [2]int64{}},
+	} {
+		os.Setenv(MED, tc.med)
+		os.Setenv(MED_OVERRIDES, tc.overrides)
+		med, overrides, err := getMEDConfig()
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, want error %t", tc.name, err, tc.err)
+		}
+		if err != nil {
+			continue
+		}
+		s := &Server{ipv4: net.ParseIP("10.0.0.1"), med: med, medOverrides: overrides}
+		for i, prefix := range []string{"192.168.1.0/26", "192.168.2.0/26"} {
+			path, err := s.makePath(prefix, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := int64(-1)
+			for _, a := range path.GetPathAttrs() {
+				if m, ok := a.(*bgp.PathAttributeMultiExitDisc); ok {
+					if !reflect.DeepEqual(m, bgp.NewPathAttributeMultiExitDisc(m.Value)) {
+						t.Errorf("%s: %s: invalid MED attribute %v", tc.name, prefix, m)
+					}
+					got = int64(m.Value)
+				}
+			}
+			if got != tc.want[i] {
+				t.Errorf("%s: %s: MED %d, want %d", tc.name, prefix, got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestReconcileNeighbors(t *testing.T) {
+	current := []*bgpconfig.Neighbor{
+		testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2"),
+		testNeighbor("10.0.0.5", 65003, "Global_10_0_0_3"),
+	}
+	desired := []*bgpconfig.Neighbor{
+		testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2"),
+		// moved to another address, which the watchers take care of
+		testNeighbor("10.0.0.3", 65003, "Global_10_0_0_3"),
+		testNeighbor("10.0.0.4", 65004, "Global_10_0_0_4"),
+		testNeighbor("10.0.0.6", 65006, ""),
+	}
+	if got := neighborAddrs(missingNeighbors(current, desired)); !reflect.DeepEqual(got, []string{"10.0.0.4", "10.0.0.6"}) {
+		t.Errorf("missing %v, want [10.0.0.4 10.0.0.6]", got)
+	}
+
+	// a neighbor the BGP server has lost is re-added
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	n := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	if err := s.addNeighbor(n); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.bgpServer.DeleteNeighbor(n); err != nil {
+		t.Fatal(err)
+	}
+	missing := missingNeighbors(s.bgpServer.GetNeighbor("", false), []*bgpconfig.Neighbor{n})
+	if len(missing) != 1 {
+		t.Fatalf("missing %v after the deletion, want %s", neighborAddrs(missing), n.Config.NeighborAddress)
+	}
+	if err := s.addNeighbor(missing[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := neighborAddrs(s.bgpServer.GetNeighbor("", false)); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("neighbors %v after the reconciliation, want [10.0.0.2]", got)
+	}
+	if missing = missingNeighbors(s.bgpServer.GetNeighbor("", false), []*bgpconfig.Neighbor{n}); len(missing) != 0 {
+		t.Errorf("missing %v after the reconciliation, want none", neighborAddrs(missing))
+	}
+}
+
+// fakeKeysAPI serves Get from 'values', keyed by the etcd key
+type fakeKeysAPI struct {
+	etcd.KeysAPI
+	values map[string]string
+	// errs are the errors of the keys which fail to be read
+	errs map[string]error
+	// get, if set, is called with the key of each Get
+	get func(key string)
+}
+
+func (api *fakeKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	if api.get != nil {
+		api.get(key)
+	}
+	if err, ok := api.errs[key]; ok {
+		return nil, err
+	}
+	v, ok := api.values[key]
+	if !ok {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	return &etcd.Response{Node: &etcd.Node{Key: key, Value: v}}, nil
+}
+
+func TestCheckDatastore(t *testing.T) {
+	forbidden := errors.New("403 Forbidden")
+	for _, tc := range []struct {
+		name string
+		errs map[string]error
+		want string
+	}{
+		{"readable", nil, ""},
+		// a key which doesn't exist yet is fine
+		{"not found", map[string]error{CALICO_AGGR: etcd.Error{Code: etcd.ErrorCodeKeyNotFound}}, ""},
+		{"forbidden", map[string]error{CALICO_IPAM: forbidden}, "failed to read " + CALICO_IPAM + " from etcd (http://127.0.0.1:2379): 403 Forbidden"},
+	} {
+		err := checkDatastore(&fakeKeysAPI{errs: tc.errs}, []string{"http://127.0.0.1:2379"})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("%s: error %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGetAssignedPrefixesNoBlock(t *testing.T) {
+	os.Setenv(NODENAME, "node1")
+	defer os.Unsetenv(NODENAME)
+	v4 := fmt.Sprintf("%s/node1/ipv4/block", CALICO_AGGR)
+	v6 := fmt.Sprintf("%s/node1/ipv6/block", CALICO_AGGR)
+	for _, tc := range []struct {
+		name  string
+		errs  map[string]error
+		index uint64
+		err   bool
+	}{
+		{"no block yet", map[string]error{
+			v4: etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Index: 42},
+			v6: etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Index: 43},
+		}, 42, false},
+		{"unreachable", map[string]error{v4: errors.New("unreachable")}, 0, true},
+	} {
+		s := &Server{ipv4: net.ParseIP("10.0.0.1"), ipv6: net.ParseIP("fd00::1")}
+		paths, index, err := s.getAssignedPrefixes(&fakeKeysAPI{errs: tc.errs})
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, want error %t", tc.name, err, tc.err)
+		}
+		if len(paths) != 0 || index != tc.index {
+			t.Errorf("%s: %d path(s), index %d, want none, %d", tc.name, len(paths), index, tc.index)
+		}
+	}
+}
+
+func TestWatchPrefixWaitsForPools(t *testing.T) {
+	os.Setenv(NODENAME, "node1")
+	defer os.Unsetenv(NODENAME)
+	unreachable := errors.New("unreachable")
+	s := &Server{ipv4: net.ParseIP("10.0.0.1"), ipam: newIPAMCache(nil)}
+	// the pools loaded when the assigned prefixes are first read; reading
+	// them fails so that watchPrefix returns right after
+	pools := -1
+	s.etcd = &fakeKeysAPI{
+		errs: map[string]error{fmt.Sprintf("%s/node1/ipv4/block", CALICO_AGGR): unreachable},
+		get: func(string) {
+			if pools < 0 {
+				pools = len(s.ipam.pools())
+			}
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.watchPrefix(0) }()
+	select {
+	case err := <-done:
+		t.Fatalf("returned before the pools were loaded: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := s.ipam.update(&etcd.Node{Value: `{"cidr":"192.168.0.0/16","ipip":"tunl0"}`}, false); err != nil {
+		t.Fatal(err)
+	}
+	close(s.ipam.ready)
+	if err := <-done; err != unreachable {
+		t.Fatalf("error %v, want %v", err, unreachable)
+	}
+	if pools != 1 {
+		t.Errorf("%d pool(s) loaded before the first prefix, want 1", pools)
+	}
+
+	// stopping doesn't wait for the pools
+	s = &Server{ipam: newIPAMCache(nil), etcd: &fakeKeysAPI{}}
+	s.t.Kill(nil)
+	if err := s.watchPrefix(0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetAdvertiseBlocks(t *testing.T) {
+	os.Setenv(NODENAME, "node1")
+	defer os.Unsetenv(NODENAME)
+	key := fmt.Sprintf("%s/host/node1/advertise_blocks", CALICO_BGP)
+	for _, tc := range []struct {
+		value string
+		want  bool
+		err   bool
+	}{
+		{"", true, false},
+		{"true", true, false},
+		{"false", false, false},
+		{"no", false, true},
+	} {
+		values := map[string]string{}
+		if tc.value != "" {
+			values[key] = tc.value
+		}
+		s := &Server{etcd: &fakeKeysAPI{values: values}}
+		got, err := s.getAdvertiseBlocks()
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v, want error %t", tc.value, err, tc.err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: advertise %t, want %t", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestStartBGP(t *testing.T) {
+	s := &Server{bgpServer: bgpserver.NewBgpServer()}
+	go s.bgpServer.Serve()
+	defer s.bgpServer.Stop()
+	n := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	// gobgp refuses neighbors until the global configuration is set
+	if err := s.addNeighbor(n); err == nil {
+		t.Fatal("a neighbor is added before the global configuration")
+	}
+	if err := s.startBGP(64512, net.ParseIP("10.0.0.1"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if c := s.bgpServer.GetServer().Config; c.As != 64512 || c.RouterId != "10.0.0.1" {
+		t.Errorf("global AS %d, router id %s, want 64512, 10.0.0.1", c.As, c.RouterId)
+	}
+	if err := s.addNeighbor(n); err != nil {
+		t.Fatal(err)
+	}
+	if got := neighborAddrs(s.bgpServer.GetNeighbor("", false)); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("neighbors %v, want [10.0.0.2]", got)
+	}
+}
+
+func TestConfederation(t *testing.T) {
+	defer os.Unsetenv(CONFEDERATION_ID)
+	defer os.Unsetenv(CONFEDERATION_MEMBERS)
+	for _, tc := range []struct {
+		id, members string
+		want        bgpconfig.ConfederationConfig
+		err         bool
+	}{
+		{"", "65001,65002", bgpconfig.ConfederationConfig{}, false},
+		{"100", "", bgpconfig.ConfederationConfig{Enabled: true, Identifier: 100}, false},
+		{"100", "65001, 65002,", bgpconfig.ConfederationConfig{Enabled: true, Identifier: 100, MemberAsList: []uint32{65001, 65002}}, false},
+		{"invalid", "65001", bgpconfig.ConfederationConfig{}, true},
+		{"100", "65001,invalid", bgpconfig.ConfederationConfig{}, true},
+	} {
+		os.Setenv(CONFEDERATION_ID, tc.id)
+		os.Setenv(CONFEDERATION_MEMBERS, tc.members)
+		c, err := getConfederationConfig()
+		if (err != nil) != tc.err {
+			t.Errorf("%q, %q: error %v, want error %t", tc.id, tc.members, err, tc.err)
+		}
+		if err == nil && !reflect.DeepEqual(c.Config, tc.want) {
+			t.Errorf("%q, %q: %+v, want %+v", tc.id, tc.members, c.Config, tc.want)
+		}
+	}
+
+	// the confederation is applied to the global configuration of gobgp
+	os.Setenv(CONFEDERATION_ID, "100")
+	os.Setenv(CONFEDERATION_MEMBERS, "65001,65002")
+	s := &Server{bgpServer: bgpserver.NewBgpServer()}
+	go s.bgpServer.Serve()
+	if err := s.startBGP(64512, net.ParseIP("10.0.0.1"), -1); err != nil {
+		t.Fatal(err)
+	}
+	defer s.bgpServer.Stop()
+	want := bgpconfig.ConfederationConfig{Enabled: true, Identifier: 100, MemberAsList: []uint32{65001, 65002}}
+	if got := s.bgpServer.GetServer().Confederation.Config; !reflect.DeepEqual(got, want) {
+		t.Errorf("global confederation %+v, want %+v", got, want)
+	}
+}
+
+func TestNodeAddresses(t *testing.T) {
+	defer os.Unsetenv(IPV4_ADDRESS)
+	defer os.Unsetenv(IPV6_ADDRESS)
+	spec := &calicoapi.NodeBGPSpec{
+		IPv4Address: &cnet.IPNet{IPNet: net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}},
+	}
+	for _, tc := range []struct {
+		name       string
+		ipv4, ipv6 string
+		want4      string
+		want6      string
+	}{
+		{"no override", "", "", "10.0.0.1", "<nil>"},
+		{"overridden", "10.0.1.1", "fd00::1", "10.0.1.1", "fd00::1"},
+		// invalid values are ignored
+		{"invalid", "10.0.1", "10.0.1.1", "10.0.0.1", "<nil>"},
+	} {
+		os.Setenv(IPV4_ADDRESS, tc.ipv4)
+		os.Setenv(IPV6_ADDRESS, tc.ipv6)
+		ipv4, ipv6 := nodeAddresses(spec)
+		if ipv4.String() != tc.want4 || ipv6.String() != tc.want6 {
+			t.Errorf("%s: %s, %s, want %s, %s", tc.name, ipv4, ipv6, tc.want4, tc.want6)
+		}
+		// the address is the next hop advertised
+		s := &Server{ipv4: ipv4, ipv6: ipv6}
+		_, prefix, _ := net.ParseCIDR("192.168.1.0/26")
+		if got := s.nexthop(prefix); got.String() != tc.want4 {
+			t.Errorf("%s: next hop %s, want %s", tc.name, got, tc.want4)
+		}
+	}
+}
+
+func TestGetDefaults(t *testing.T) {
+	defer os.Unsetenv(DEFAULT_AS)
+	defer os.Unsetenv(DEFAULT_NODE_MESH)
+	for _, tc := range []struct {
+		asn, mesh string
+		wantASN   numorstring.ASNumber
+		wantMesh  bool
+		err       bool
+	}{
+		{"", "", 64512, true, false},
+		{"65000", "false", 65000, false, false},
+		{"4200000000", "", 4200000000, true, false},
+		{"invalid", "", 0, false, true},
+		{"", "maybe", 0, false, true},
+	} {
+		os.Setenv(DEFAULT_AS, tc.asn)
+		os.Setenv(DEFAULT_NODE_MESH, tc.mesh)
+		asn, mesh, err := getDefaults()
+		if (err != nil) != tc.err {
+			t.Errorf("%q, %q: error %v, want error %t", tc.asn, tc.mesh, err, tc.err)
+		}
+		if err != nil {
+			continue
+		}
+		if asn != tc.wantASN || mesh.Enabled != tc.wantMesh {
+			t.Errorf("%q, %q: %d, %t, want %d, %t", tc.asn, tc.mesh, asn, mesh.Enabled, tc.wantASN, tc.wantMesh)
+		}
+
+		// the defaults apply when etcd has no values
+		sources, err := getASNPrecedence()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{
+			etcd:        &fakeKeysAPI{},
+			defaultASN:  asn,
+			defaultMesh: mesh,
+			asnSources:  sources,
+		}
+		if got, _, err := s.resolveASN("node1"); err != nil || got != tc.wantASN {
+			t.Errorf("%q: AS number %d (%v), want %d", tc.asn, got, err, tc.wantASN)
+		}
+		if got, err := s.getMeshConfig(); err != nil || got.Enabled != tc.wantMesh {
+			t.Errorf("%q: mesh %v (%v), want %t", tc.mesh, got, err, tc.wantMesh)
+		}
+	}
+}
+
+func TestResolveASN(t *testing.T) {
+	nodeKey := fmt.Sprintf("%s/host/node1/as_num", CALICO_BGP)
+	globalKey := fmt.Sprintf("%s/global/as_num", CALICO_BGP)
+	defer os.Unsetenv(ASN_PRECEDENCE)
+	for _, tc := range []struct {
+		precedence string
+		node       string
+		global     string
+		want       numorstring.ASNumber
+		none       bool
+	}{
+		{"", "65001", "65002", 65001, false},
+		{"", "", "65002", 65002, false},
+		{"", "", "", 64512, false},
+		// an invalid AS number falls through to the next source
+		{"", "", "invalid", 64512, false},
+		{"", "invalid", "65002", 65002, false},
+		{"global,node,default", "65001", "65002", 65002, false},
+		{"global,node,default", "65001", "", 65001, false},
+		{"global,node,default", "invalid", "", 64512, false},
+		{"default,node", "65001", "65002", 64512, false},
+		{"node,global", "", "", 0, true},
+		{"node,global", "invalid", "invalid", 0, true},
+		{"node, global ,", "", "65002", 65002, false},
+	} {
+		os.Setenv(ASN_PRECEDENCE, tc.precedence)
+		sources, err := getASNPrecedence()
+		if err != nil {
+			t.Fatalf("%q: %s", tc.precedence, err)
+		}
+		values := map[string]string{}
+		if tc.node != "" {
+			values[nodeKey] = tc.node
+		}
+		if tc.global != "" {
+			values[globalKey] = tc.global
+		}
+		s := &Server{
+			etcd:       &fakeKeysAPI{values: values},
+			defaultASN: 64512,
+			asnSources: sources,
+		}
+		got, ok, err := s.resolveASN("node1")
+		if err != nil {
+			t.Fatalf("%q, node %q, global %q: %s", tc.precedence, tc.node, tc.global, err)
+		}
+		if ok == tc.none {
+			t.Errorf("%q, node %q, global %q: found %t, want %t", tc.precedence, tc.node, tc.global, ok, !tc.none)
+		}
+		if got != tc.want {
+			t.Errorf("%q, node %q, global %q: AS number %d, want %d", tc.precedence, tc.node, tc.global, got, tc.want)
+		}
+	}
+	for _, v := range []string{"node,label", ",", "node;global"} {
+		os.Setenv(ASN_PRECEDENCE, v)
+		if _, err := getASNPrecedence(); err == nil {
+			t.Errorf("%q: no error", v)
+		}
+	}
+}
+
+func TestMeshASN(t *testing.T) {
+	os.Setenv(NODENAME, "node1")
+	defer os.Unsetenv(NODENAME)
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	values := map[string]string{
+		fmt.Sprintf("%s/global/as_num", CALICO_BGP):         "65002",
+		fmt.Sprintf("%s/host/node2/as_num", CALICO_BGP):     "65001",
+		fmt.Sprintf("%s/host/node2/ip_addr_v4", CALICO_BGP): "10.0.0.2",
+	}
+	s.etcd = &fakeKeysAPI{values: values}
+	s.asnSources = []string{"global", "node"}
+	mesh := &meshConfig{Enabled: true}
+	node := func(name, addr string) calicoapi.Node {
+		n := calicoapi.Node{}
+		n.Metadata.Name = name
+		n.Spec.BGP = &calicoapi.NodeBGPSpec{
+			IPv4Address: &cnet.IPNet{IPNet: net.IPNet{IP: net.ParseIP(addr), Mask: net.CIDRMask(32, 32)}},
+		}
+		return n
+	}
+	nodes := []calicoapi.Node{node("node1", "10.0.0.1"), node("node2", "10.0.0.2")}
+	peerAs := func() uint32 {
+		ns := s.bgpServer.GetNeighbor("", false)
+		if len(ns) != 1 {
+			t.Fatalf("neighbors %v, want 10.0.0.2 only", neighborAddrs(ns))
+		}
+		return ns[0].Config.PeerAs
+	}
+	// checks that the initial build and the watcher resolve the same AS number
+	check := func(want uint32) {
+		ns, err := s.meshNeighbors(nodes, mesh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ns) != 1 || ns[0].Config.PeerAs != want {
+			t.Fatalf("initial build: %v, want 10.0.0.2 with AS %d", ns, want)
+		}
+		if err = s.updateMeshASN("node2", mesh); err != nil {
+			t.Fatal(err)
+		}
+		if got := peerAs(); got != want {
+			t.Errorf("watcher: AS %d, want %d", got, want)
+		}
+	}
+
+	ns, err := s.meshNeighbors(nodes, mesh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range ns {
+		if err = s.addNeighbor(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the global AS number comes first, even over the one set for the node
+	check(65002)
+	values[fmt.Sprintf("%s/host/node2/as_num", CALICO_BGP)] = "65003"
+	check(65002)
+	// an invalid global AS number falls through to the node
+	values[fmt.Sprintf("%s/global/as_num", CALICO_BGP)] = "invalid"
+	check(65003)
+
+	// a host without any AS number is skipped, and the others are kept
+	nodes = append(nodes, node("node3", "10.0.0.3"))
+	s.asnSources = []string{"node"}
+	if ns, err = s.meshNeighbors(nodes, mesh); err != nil {
+		t.Fatal(err)
+	}
+	if got := neighborAddrs(ns); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("neighbors %v, want [10.0.0.2]", got)
+	}
+	if err = s.updateMeshASN("node3", mesh); err != nil {
+		t.Error(err)
+	}
+	if got := peerAs(); got != 65003 {
+		t.Errorf("AS %d, want 65003", got)
+	}
+}
+
+func TestMeshASNFailure(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	asnKey := func(host string) string {
+		return fmt.Sprintf("%s/host/%s/as_num", CALICO_BGP, host)
+	}
+	s.etcd = &fakeKeysAPI{
+		values: map[string]string{
+			asnKey("node3"): "65003",
+			fmt.Sprintf("%s/host/node2/ip_addr_v4", CALICO_BGP): "10.0.0.2",
+			fmt.Sprintf("%s/host/node3/ip_addr_v4", CALICO_BGP): "10.0.0.3",
+		},
+		errs: map[string]error{
+			asnKey("node2"): errors.New("etcd is unavailable"),
+		},
+	}
+	s.asnSources = []string{"node"}
+	mesh := &meshConfig{Enabled: true}
+	for _, n := range []*bgpconfig.Neighbor{
+		s.newMeshNeighbor("10.0.0.2", 65002),
+		s.newMeshNeighbor("10.0.0.3", 65002),
+	} {
+		if err := s.addNeighbor(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the failure for node2 is logged and doesn't stop node3
+	for _, host := range []string{"node2", "node3"} {
+		if err := s.updateMeshASN(host, mesh); err != nil {
+			t.Errorf("%s: %s", host, err)
+		}
+	}
+	for addr, want := range map[string]uint32{
+		// kept as it was
+		"10.0.0.2": 65002,
+		"10.0.0.3": 65003,
+	} {
+		ns := s.bgpServer.GetNeighbor(addr, false)
+		if len(ns) != 1 || ns[0].Config.PeerAs != want {
+			t.Errorf("%s: %v, want AS %d", addr, neighborAddrs(ns), want)
+		}
+	}
+}
+
+func TestMeshHostAllowed(t *testing.T) {
+	defer os.Unsetenv(MESH_ALLOW)
+	defer os.Unsetenv(MESH_DENY)
+	node := func(name, addr string) calicoapi.Node {
+		n := calicoapi.Node{}
+		n.Metadata.Name = name
+		n.Spec.BGP = &calicoapi.NodeBGPSpec{
+			IPv4Address: &cnet.IPNet{IPNet: net.IPNet{IP: net.ParseIP(addr), Mask: net.CIDRMask(32, 32)}},
+		}
+		return n
+	}
+	nodes := []calicoapi.Node{node("node2", "10.0.0.2"), node("edge1", "10.0.0.3"), node("node4", "10.0.0.4")}
+	s := &Server{defaultASN: 64512, asnSources: []string{"default"}}
+	for _, tc := range []struct {
+		name  string
+		allow string
+		deny  string
+		want  []string
+	}{
+		{"no lists", "", "", []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+		{"denied", "", "edge1", []string{"10.0.0.2", "10.0.0.4"}},
+		{"allowed", "node2, node4", "", []string{"10.0.0.2", "10.0.0.4"}},
+		// the deny list wins over the allow list
+		{"allowed and denied", "node2,edge1", " edge1 ", []string{"10.0.0.2"}},
+	} {
+		os.Setenv(MESH_ALLOW, tc.allow)
+		os.Setenv(MESH_DENY, tc.deny)
+		ns, err := s.meshNeighbors(nodes, &meshConfig{Enabled: true})
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := neighborAddrs(ns); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: mesh neighbors %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIPv6AS(t *testing.T) {
+	node := calicoapi.Node{}
+	node.Metadata.Name = "node2"
+	node.Spec.BGP = &calicoapi.NodeBGPSpec{
+		IPv4Address: &cnet.IPNet{IPNet: net.IPNet{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)}},
+		IPv6Address: &cnet.IPNet{IPNet: net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(128, 128)}},
+	}
+	type as struct{ peer, local uint32 }
+	for _, tc := range []struct {
+		name    string
+		ipv6ASN numorstring.ASNumber
+		// keyed by the neighbor address; a zero local AS is the global one
+		want map[string]as
+	}{
+		{"unset", 0, map[string]as{
+			"10.0.0.2":    {64512, 0},
+			"fd00::2":     {64512, 0},
+			"192.0.2.2":   {64513, 0},
+			"2001:db8::2": {64513, 0},
+		}},
+		{"set", 65100, map[string]as{
+			"10.0.0.2":    {64512, 0},
+			"fd00::2":     {65100, 65100},
+			"192.0.2.2":   {64513, 0},
+			"2001:db8::2": {64513, 65100},
+		}},
+	} {
+		s := &Server{defaultASN: 64512, asnSources: []string{"default"}, ipv6ASN: tc.ipv6ASN}
+		ns, err := s.meshNeighbors([]calicoapi.Node{node}, &meshConfig{Enabled: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range []string{"192.0.2.2", "2001:db8::2"} {
+			n, err := s.neighborFromPeerConfig(&peerConfig{IP: addr, ASN: "64513"}, "global", 64512)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns = append(ns, n)
+		}
+		got := make(map[string]as)
+		for _, n := range ns {
+			got[n.Config.NeighborAddress] = as{n.Config.PeerAs, n.Config.LocalAs}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateMeshFamilies(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	ns := []*bgpconfig.Neighbor{
+		s.newMeshNeighbor("10.0.0.2", 64512),
+		s.newMeshNeighbor("10.0.0.3", 64512),
+		s.newMeshNeighbor("10.0.0.4", 64512),
+		s.newMeshNeighbor("fd00::2", 64512),
+	}
+	no := false
+	update := func(prev, cur meshConfig) error {
+		return s.updateMeshFamilies(ns, &prev, &cur)
+	}
+	if err := update(meshConfig{}, meshConfig{Enabled: true, IPv6: &no}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := neighborAddrs(s.bgpServer.GetNeighbor("", false)), []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("neighbors %v, want %v", got, want)
+	}
+	// a neighbor removed behind the daemon's back fails to be deleted
+	if err := s.bgpServer.DeleteNeighbor(ns[1]); err != nil {
+		t.Fatal(err)
+	}
+	err := update(meshConfig{Enabled: true, IPv6: &no}, meshConfig{})
+	if err == nil || !strings.Contains(err.Error(), "10.0.0.3") {
+		t.Errorf("error %v, want the failure of 10.0.0.3", err)
+	}
+	// the other neighbors are updated all the same
+	if got := neighborAddrs(s.bgpServer.GetNeighbor("", false)); len(got) != 0 {
+		t.Errorf("neighbors %v, want none", got)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "maintenance")
+	os.Setenv(MAINTENANCE_FILE, path)
+	defer os.Unsetenv(MAINTENANCE_FILE)
+
+	s := &Server{maintenanceWait: 10 * time.Millisecond}
+	applied := make(chan string, 1)
+	c := newIPAMCache(nil, func(p *ipPool) error {
+		applied <- p.CIDR
+		return nil
+	})
+	c.pause = func() { s.waitMaintenance("ipam") }
+	// applies a change like the watch loop of sync
+	apply := func(cidr string) {
+		c.pause()
+		if err := c.update(&etcd.Node{Value: fmt.Sprintf(`{"cidr":"%s"}`, cidr)}, false); err != nil {
+			t.Error(err)
+		}
+	}
+
+	apply("192.168.0.0/16")
+	if got := <-applied; got != "192.168.0.0/16" {
+		t.Fatalf("applied %s, want 192.168.0.0/16", got)
+	}
+
+	if err = ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !s.inMaintenance() {
+		t.Fatal("not in maintenance mode with the file")
+	}
+	go apply("10.0.0.0/8")
+	select {
+	case got := <-applied:
+		t.Fatalf("applied %s in maintenance mode", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// removing the file applies the change held back
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-applied:
+		if got != "10.0.0.0/8" {
+			t.Errorf("applied %s after the maintenance, want 10.0.0.0/8", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the change held back wasn't applied after the maintenance")
+	}
+	if s.inMaintenance() {
+		t.Error("in maintenance mode without the file")
+	}
+}
+
+func TestAdvertisedPaths(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	prefixes := func() []string {
+		paths, err := s.AdvertisedPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ps []string
+		for _, path := range paths {
+			ps = append(ps, path.GetNlri().String())
+		}
+		sort.Strings(ps)
+		return ps
+	}
+	advertise(t, s, "192.168.1.0/26", "192.168.2.0/26", "fd00:1::/122")
+	if got, want := prefixes(), []string{"192.168.1.0/26", "192.168.2.0/26", "fd00:1::/122"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("advertised %v, want %v", got, want)
+	}
+	path, err := s.makePath("192.168.2.0/26", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.addPath("", []*bgptable.Path{path}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := prefixes(), []string{"192.168.1.0/26", "fd00:1::/122"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("advertised after the withdrawal %v, want %v", got, want)
+	}
+}
+
+func TestWaitEstablished(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// the session is reported established from this lookup on; zero
+		// is never
+		establishedAt int
+		want          bool
+	}{
+		{"established at once", 1, true},
+		{"established later", 2, true},
+		{"never established", 0, false},
+	} {
+		lookups := 0
+		s := &Server{
+			neighbors: func(string) []*bgpconfig.Neighbor {
+				lookups++
+				n := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+				if tc.establishedAt > 0 && lookups >= tc.establishedAt {
+					n.State.SessionState = bgpconfig.SESSION_STATE_ESTABLISHED
+				}
+				return []*bgpconfig.Neighbor{n}
+			},
+		}
+		// the prefixes are advertised only after this returns
+		if got := s.waitEstablished(1500 * time.Millisecond); got != tc.want {
+			t.Errorf("%s: established %t, want %t", tc.name, got, tc.want)
+		}
+		if tc.want && lookups != tc.establishedAt {
+			t.Errorf("%s: returned after %d lookup(s), want %d", tc.name, lookups, tc.establishedAt)
+		}
+	}
+}
+
+func TestLogConfig(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	s.ipam = newIPAMCache(nil)
+	if err := s.ipam.update(&etcd.Node{Value: `{"cidr":"192.168.0.0/16","ipip":"tunl0"}`}, false); err != nil {
+		t.Fatal(err)
+	}
+	advertise(t, s, "192.168.1.0/26")
+	n := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	n.Config.AuthPassword = "secret"
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	if err := s.logConfig([]*bgpconfig.Neighbor{n}); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"neighbor: ",
+		"10.0.0.2",
+		"redacted",
+		"ip pool: ",
+		"192.168.0.0/16",
+		"advertised path: ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%s isn't logged in %q", want, out)
+		}
+	}
+	if strings.Contains(out, "secret") {
+		t.Errorf("the password is logged in %q", out)
+	}
+	// the neighbor given is not changed
+	if n.Config.AuthPassword != "secret" {
+		t.Errorf("password %q, want secret", n.Config.AuthPassword)
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	n := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	n.Config.AuthPassword = "secret"
+	if err := s.addNeighbor(n); err != nil {
+		t.Fatal(err)
+	}
+	advertise(t, s, "192.168.1.0/26")
+
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.json")
+	if err = s.dumpState(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d struct {
+		Neighbors []*bgpconfig.Neighbor                   `json:"neighbors"`
+		Global    map[string][]json.RawMessage            `json:"global"`
+		AdjIn     map[string]map[string][]json.RawMessage `json:"adj_in"`
+		AdjOut    map[string]map[string][]json.RawMessage `json:"adj_out"`
+	}
+	if err = json.Unmarshal(b, &d); err != nil {
+		t.Fatal(err)
+	}
+	if got := neighborAddrs(d.Neighbors); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("neighbors %v, want [10.0.0.2]", got)
+	} else if pw := d.Neighbors[0].Config.AuthPassword; pw != "<redacted>" {
+		t.Errorf("password %q, want it redacted", pw)
+	}
+	if paths := d.Global[bgp.RF_IPv4_UC.String()]; len(paths) != 1 || !strings.Contains(string(paths[0]), "192.168.1.0/26") {
+		t.Errorf("global IPv4 RIB %s, want the path of 192.168.1.0/26", paths)
+	}
+	if _, ok := d.Global[bgp.RF_IPv6_UC.String()]; !ok {
+		t.Error("no global IPv6 RIB")
+	}
+	if _, ok := d.AdjIn["10.0.0.2"]; !ok {
+		t.Error("no Adj-RIB-In of 10.0.0.2")
+	}
+	if _, ok := d.AdjOut["10.0.0.2"]; !ok {
+		t.Error("no Adj-RIB-Out of 10.0.0.2")
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	n := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	n.State.SessionState = bgpconfig.SESSION_STATE_ESTABLISHED
+	s.neighbors = func(string) []*bgpconfig.Neighbor {
+		return []*bgpconfig.Neighbor{n}
+	}
+	s.status = newSyncStatus()
+	s.status.markSynced("prefix")
+	s.ipam = newIPAMCache(nil)
+	if err := s.ipam.update(&etcd.Node{Value: `{"cidr":"192.168.0.0/16"}`}, false); err != nil {
+		t.Fatal(err)
+	}
+	advertise(t, s, "192.168.1.0/26")
+
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status.json")
+	if err = s.writeStatus(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file is left: %v", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys sidecars rely on
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"neighbors", "advertised", "pools", "last_synced", "stale", "maintenance"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("no %q in %s", key, b)
+		}
+	}
+	var st status
+	if err = json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	want := []neighborStatus{{"10.0.0.2", 65002, "Global_10_0_0_2", string(bgpconfig.SESSION_STATE_ESTABLISHED)}}
+	if !reflect.DeepEqual(st.Neighbors, want) {
+		t.Errorf("neighbors %v, want %v", st.Neighbors, want)
+	}
+	if !reflect.DeepEqual(st.Advertised, []string{"192.168.1.0/26"}) {
+		t.Errorf("advertised %v, want [192.168.1.0/26]", st.Advertised)
+	}
+	if st.Pools != 1 {
+		t.Errorf("%d pool(s), want 1", st.Pools)
+	}
+	if _, ok := st.LastSynced["prefix"]; !ok {
+		t.Errorf("last synced %v, want the prefix sync", st.LastSynced)
+	}
+}
+
+func TestMakePathNexthop(t *testing.T) {
+	s := &Server{
+		ipv4: net.ParseIP("10.0.0.1"),
+		ipv6: net.ParseIP("fd00::1"),
+	}
+	for prefix, want := range map[string]string{
+		"192.168.1.0/26": "10.0.0.1",
+		"fd00:1::/122":   "fd00::1",
+	} {
+		path, err := s.makePath(prefix, false)
+		if err != nil {
+			t.Errorf("%s: %s", prefix, err)
+			continue
+		}
+		if got := path.GetNexthop(); !got.Equal(net.ParseIP(want)) {
+			t.Errorf("%s: next hop %s, want %s", prefix, got, want)
+		}
+	}
+
+	// a node without an IPv6 address can't advertise IPv6 prefixes
+	s.ipv6 = nil
+	_, err := s.makePath("fd00:1::/122", false)
+	if _, ok := err.(*noNexthopError); !ok {
+		t.Errorf("error %v, want a noNexthopError", err)
+	} else if !strings.Contains(err.Error(), "IPv6") {
+		t.Errorf("error %q doesn't name the address family", err)
+	}
+}
+
+func TestLoopbackNexthop(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	s.loopback = net.ParseIP("10.255.0.1")
+	if err := s.advertiseLoopback(); err != nil {
+		t.Fatal(err)
+	}
+	if !advertised(t, s, "10.255.0.1/32") {
+		t.Error("the loopback host route isn't advertised")
+	}
+	for prefix, want := range map[string]string{
+		"192.168.1.0/26": "10.255.0.1",
+		// the loopback host route itself and the other family keep the
+		// address of the node
+		"10.255.0.1/32": "10.0.0.1",
+		"fd00:1::/122":  "fd00::1",
+	} {
+		path, err := s.makePath(prefix, false)
+		if err != nil {
+			t.Errorf("%s: %s", prefix, err)
+			continue
+		}
+		if got := path.GetNexthop(); !got.Equal(net.ParseIP(want)) {
+			t.Errorf("%s: next hop %s, want %s", prefix, got, want)
+		}
+	}
+}
+
+func TestAnycast(t *testing.T) {
+	addrs := []string{"10.255.255.1", " fd00:ff::1", ""}
+	// every node originates the same routes, each with its own next hop
+	for _, node := range []struct {
+		ipv4 string
+		ipv6 string
+	}{
+		{"10.0.0.1", "fd00::1"},
+		{"10.0.0.2", "fd00::2"},
+	} {
+		s := newTestServer(t)
+		s.ipv4 = net.ParseIP(node.ipv4)
+		s.ipv6 = net.ParseIP(node.ipv6)
+		if err := s.advertiseAnycast(addrs); err != nil {
+			t.Fatal(err)
+		}
+		paths, err := s.AdvertisedPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nexthops := make(map[string]string)
+		for _, path := range paths {
+			nexthops[path.GetNlri().String()] = path.GetNexthop().String()
+		}
+		want := map[string]string{
+			"10.255.255.1/32": node.ipv4,
+			"fd00:ff::1/128":  node.ipv6,
+		}
+		if !reflect.DeepEqual(nexthops, want) {
+			t.Errorf("node %s: %v, want %v", node.ipv4, nexthops, want)
+		}
+		s.bgpServer.Stop()
+	}
+
+	s := &Server{}
+	if err := s.advertiseAnycast([]string{"anycast"}); err == nil {
+		t.Error("no error for an invalid address")
+	}
+}
+
+func TestWithdrawPathSet(t *testing.T) {
+	s := newTestServer(t)
+	defer s.bgpServer.Stop()
+	advertise(t, s, "192.168.1.0/26")
+	if err := s.advertisePrefixes([]string{"198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.advertiseCanaries([]string{"203.0.113.0/25", " 203.0.113.128/25", ""}); err != nil {
+		t.Fatal(err)
+	}
+	prefixes := func() []string {
+		paths, err := s.AdvertisedPaths()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var l []string
+		for _, path := range paths {
+			l = append(l, path.GetNlri().String())
+		}
+		sort.Strings(l)
+		return l
+	}
+	if got, want := prefixes(), []string{"192.168.1.0/26", "198.51.100.0/24", "203.0.113.0/25", "203.0.113.128/25"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("advertised %v, want %v", got, want)
+	}
+	// the canaries only are withdrawn, and withdrawing them again is a no-op
+	for i := 0; i < 2; i++ {
+		if err := s.WithdrawPathSet(canaryPathSet); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := prefixes(), []string{"192.168.1.0/26", "198.51.100.0/24"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("advertised %v, want %v", got, want)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	q := newNeighborQuarantine(3, time.Minute)
+	failing := testNeighbor("10.0.0.2", 65002, "Global_10_0_0_2")
+	established := testNeighbor("10.0.0.3", 65003, "Global_10_0_0_3")
+	established.State.SessionState = bgpconfig.SESSION_STATE_ESTABLISHED
+	ns := []*bgpconfig.Neighbor{failing, established}
+
+	var disabled, enabled []string
+	disable := func(addr string) error {
+		disabled = append(disabled, addr)
+		return nil
+	}
+	enable := func(addr string) error {
+		enabled = append(enabled, addr)
+		return nil
+	}
+	start := time.Now()
+	for _, tc := range []struct {
+		name     string
+		at       time.Duration
+		ns       []*bgpconfig.Neighbor
+		disabled []string
+		enabled  []string
+		metric   int64
+	}{
+		{"first failure", 0, ns, nil, nil, 0},
+		{"second failure", 30 * time.Second, ns, nil, nil, 0},
+		{"threshold reached", time.Minute, ns, []string{"10.0.0.2"}, nil, 1},
+		{"still quarantined", 90 * time.Second, ns, nil, nil, 1},
+		{"quarantine over", 2 * time.Minute, ns, nil, []string{"10.0.0.2"}, 0},
+		// the failures start over once released
+		{"failure after release", 150 * time.Second, ns, nil, nil, 0},
+		{"deleted", 3 * time.Minute, ns[1:], nil, nil, 0},
+		// a deleted neighbor added again starts from zero
+		{"added again", 210 * time.Second, ns, nil, nil, 0},
+	} {
+		disabled, enabled = nil, nil
+		q.check(start.Add(tc.at), tc.ns, disable, enable)
+		if !reflect.DeepEqual(disabled, tc.disabled) {
+			t.Errorf("%s: disabled %v, want %v", tc.name, disabled, tc.disabled)
+		}
+		if !reflect.DeepEqual(enabled, tc.enabled) {
+			t.Errorf("%s: enabled %v, want %v", tc.name, enabled, tc.enabled)
+		}
+		if got := neighborsQuarantinedMetric.Value(); got != tc.metric {
+			t.Errorf("%s: %d neighbor(s) quarantined, want %d", tc.name, got, tc.metric)
+		}
+	}
+}
+
+func TestVRF(t *testing.T) {
+	defer os.Unsetenv(VRF_RD)
+	defer os.Unsetenv(VRF_RT)
+	for _, tc := range []struct {
+		name string
+		rd   string
+		rt   string
+		err  bool
+	}{
+		{"invalid rd", "rd", "64512:1", true},
+		{"no rt", "64512:1", "", true},
+		{"invalid rt", "64512:1", "64512:1,rt", true},
+		{"valid", "64512:1", "64512:1, 64512:2", false},
+	} {
+		s := newTestServer(t)
+		s.vrf = "tenant"
+		os.Setenv(VRF_RD, tc.rd)
+		os.Setenv(VRF_RT, tc.rt)
+		err := s.addVRF()
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, want error %t", tc.name, err, tc.err)
+		}
+		if err != nil {
+			s.bgpServer.Stop()
+			continue
+		}
+		vrfs := s.bgpServer.GetVrf()
+		if len(vrfs) != 1 || vrfs[0].Name != "tenant" || vrfs[0].Rd.String() != tc.rd {
+			t.Errorf("%s: VRFs %v, want tenant with RD %s", tc.name, vrfs, tc.rd)
+		}
+
+		path, err := s.makePath("192.168.1.0/26", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.addBlockPaths([]*bgptable.Path{path}); err != nil {
+			t.Fatal(err)
+		}
+		rib, err := s.bgpServer.GetVrfRib("tenant", bgp.RF_IPv4_UC, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, d := range rib.GetDestinations() {
+			if strings.HasSuffix(d.GetNlri().String(), "192.168.1.0/26") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: 192.168.1.0/26 isn't advertised in the VRF", tc.name)
+		}
+		if advertised(t, s, "192.168.1.0/26") {
+			t.Errorf("%s: 192.168.1.0/26 is advertised in the global table", tc.name)
+		}
+		s.bgpServer.Stop()
+	}
+}